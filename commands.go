@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder"
+)
+
+// Exit codes of the subcommands.
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+const commandsUsage = `
+Commands (run after all flags, exit with 0 on success, 1 on failure & 2 on usage errors):
+  render            print the configs which would be generated and exit
+  validate          check the -config file, all destinations and the configs & log files of all containers
+  inspect CONTAINER print the files & fields CONTAINER is shipped with
+  debug-receiver [ADDR [CERT KEY [CA]]]
+                    receive lumberjack events on ADDR (default :5043) and print them until interrupted,
+                    using a throwaway certificate unless CERT & KEY are given - client certificates
+                    are verified against CA if given
+`
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprint(os.Stderr, commandsUsage)
+}
+
+// checkCommand exits with exitUsage if args is not a valid command.
+func checkCommand(args []string) {
+	switch {
+	case len(args) == 0:
+		return
+	case (args[0] == "render" || args[0] == "validate") && len(args) == 1:
+		return
+	case args[0] == "inspect" && len(args) == 2:
+		return
+	case args[0] == "debug-receiver" && len(args) != 3 && len(args) <= 5:
+		return
+	}
+	usage()
+	os.Exit(exitUsage)
+}
+
+// runCommand runs the command in args and returns the exit code.
+func runCommand(args []string) int {
+	options := refreshOptions()
+
+	switch args[0] {
+	case "render":
+		rendered, err := forwarder.Render(daemons, options)
+		if err != nil {
+			log.Error("%s", err)
+			return exitFailed
+		}
+		for _, r := range rendered {
+			if len(rendered) > 1 {
+				fmt.Printf("# %s: %s\n", r.Destination, r.Path)
+			}
+			os.Stdout.Write(r.Content)
+		}
+	case "validate":
+		problems := forwarder.Validate(daemons, options)
+		for _, problem := range problems {
+			log.Error("%s", problem)
+		}
+		if len(problems) > 0 {
+			return exitFailed
+		}
+		log.Info("No problems found")
+	case "inspect":
+		inspections, err := forwarder.Inspect(daemons, options, args[1])
+		if err != nil {
+			log.Error("%s", err)
+			return exitFailed
+		}
+		j, err := json.MarshalIndent(inspections, "", "  ")
+		if err != nil {
+			log.Error("%s", err)
+			return exitFailed
+		}
+		fmt.Println(string(j))
+	}
+	return exitOK
+}
@@ -3,34 +3,109 @@ package main
 import (
 	"flag"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder"
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
 	"github.com/digital-wonderland/docker-logstash-forwarder/utils"
-	docker "github.com/fsouza/go-dockerclient"
 	logging "github.com/op/go-logging"
 )
 
 var (
-	client           *docker.Client
-	configFile       string
-	debug            bool
-	dockerEndPoint   string
-	laziness         int
-	log              = logging.MustGetLogger("main")
-	logFormat        = logging.MustStringFormatter("%{color}%{time:2006/01/02 15:04:05.000000} %{level} [%{shortfunc}]%{color:reset} %{message}")
-	logstashEndPoint string
-	quiet            bool
-	wg               sync.WaitGroup
+	allowContainerNetwork bool
+	backend               *forwarder.Backend
+	backendName           string
+	backendOptions        = utils.MapFlag{}
+	configDir             string
+	configFile            string
+	configMu              sync.Mutex // guards the config read from files at runtime
+	daemons               []*forwarder.Daemon
+	debug                 bool
+	dockerAPIVersion      string
+	dockerCA              string
+	dockerCert            string
+	dockerEndPoint        string
+	dockerKey             string
+	envCapture            string
+	excludeOneOff         bool
+	fieldGroups           string
+	filesChanged          int32
+	fragmentsDir          string
+	fwd                   = forwarder.New(nil)
+	gracePeriod           int
+	hostFiles             = utils.ListMapFlag{}
+	labelAllow            string
+	labelDeny             string
+	labelMaxLength        int
+	labelRedact           string
+	labelRedactMode       string
+	laziness              int
+	log                   = logging.MustGetLogger("main")
+	logFormat             = logging.MustStringFormatter("%{color}%{time:2006/01/02 15:04:05.000000} %{level} [%{shortfunc}]%{color:reset} %{message}")
+	logstashEndPoint      string
+	metadata              *config.Metadata
+	probe                 bool
+	quiet                 bool
+	readyAddr             string
+	readyFile             string
+	schemaName            string
+	spoolDir              string
+	startupTimeout        int
+	staticFields          = utils.MapFlag{}
+	stateDir              string
+	templateFile          string
+	tmpl                  *template.Template
+	watch                 bool
+	watcher               *utils.FileWatcher
+	wg                    sync.WaitGroup
+	wrapperConfig         *config.WrapperConfig
+	wrapperFile           string
 )
 
 func initFlags() {
-	flag.StringVar(&dockerEndPoint, "docker", "", "docker api endpoint - defaults to $DOCKER_HOST or unix:///var/run/docker.sock")
+	flag.StringVar(&dockerEndPoint, "docker", "", "docker api endpoint - defaults to $DOCKER_HOST or unix:///var/run/docker.sock. Multiple daemons must be separated with ',' and can be given as [name=]endpoint[@/local/data/root]")
+	flag.StringVar(&dockerCert, "docker-cert", "", "client certificate for docker - defaults to $DOCKER_CERT_PATH/cert.pem if $DOCKER_TLS_VERIFY is set")
+	flag.StringVar(&dockerKey, "docker-key", "", "client key for docker - defaults to $DOCKER_CERT_PATH/key.pem if $DOCKER_TLS_VERIFY is set")
+	flag.StringVar(&dockerCA, "docker-ca", "", "CA certificate to verify docker with - defaults to $DOCKER_CERT_PATH/ca.pem if $DOCKER_TLS_VERIFY is set")
+	flag.StringVar(&dockerAPIVersion, "docker-api-version", "", "docker api version to use - defaults to $DOCKER_API_VERSION or the version of the daemon")
+	flag.IntVar(&startupTimeout, "startup-timeout", 60, "number of seconds to retry connecting to docker (and logstash with -probe-logstash) on startup - commands do not retry")
+	flag.BoolVar(&probe, "probe-logstash", false, "wait for all logstash servers to accept a (TLS) connection before starting to ship")
+	flag.StringVar(&readyFile, "ready-file", "", "file to create once the first configuration got generated, removed on shutdown")
+	flag.StringVar(&readyAddr, "ready-addr", "", "address to serve /ready on (i.e. :8080) - answering 503 until the first configuration got generated")
 	flag.BoolVar(&debug, "debug", false, "verbose logging")
 	flag.IntVar(&laziness, "lazyness", 5, "number of seconds to wait after an event before generating new configuration")
 	flag.StringVar(&logstashEndPoint, "logstash", "", "logstash endpoint - defaults to $LOGSTASH_HOST or logstash:5043. Multiple hosts must be separated with ','")
 	flag.StringVar(&configFile, "config", "", "logstash-forwarder config")
+	flag.StringVar(&configDir, "config-dir", "/tmp", "directory to write the generated configs to")
+	flag.BoolVar(&allowContainerNetwork, "allow-container-network", false, "allow in container configs to define their own network section")
+	flag.StringVar(&backendName, "backend", "logstash-forwarder", "log shipper to configure and run: logstash-forwarder, fluent-bit or promtail")
+	flag.Var(backendOptions, "backend-option", "key=value made available to templates as .Settings - can be repeated")
+	flag.StringVar(&fragmentsDir, "fragments", "", "write one config fragment per container below this directory instead of restarting the backend (fluent-bit & promtail only)")
+	flag.StringVar(&spoolDir, "split-streams", "", "split docker log files by stream into spool files below this directory, shipping stdout & stderr as separate files")
+	flag.StringVar(&stateDir, "state-dir", "/var/lib/docker-logstash-forwarder", "directory containing the working directory (and so the registry) of every backend instance, named after its destination")
+	flag.StringVar(&templateFile, "template", "", "text/template to render instead of the logstash-forwarder config")
+	flag.StringVar(&wrapperFile, "wrapper-config", "", "docker-logstash-forwarder config (i.e. defining additional destinations)")
+	flag.Var(staticFields, "field", "key=value added to every file section not setting key itself - can be repeated")
+	flag.Var(hostFiles, "host-file", "type=path to ship the host file(s) at path (globs separated with ',') with that type - can be repeated, the paths of repeated types are combined")
+	flag.BoolVar(&watch, "watch", true, "refresh when the -config, -template or -wrapper-config file or any ssl file changes (linux only)")
 	flag.BoolVar(&quiet, "quiet", false, "run logstash-forwarder with -quiet")
+	flag.StringVar(&schemaName, "schema", "legacy", "field naming schema: legacy, ecs or the path of a JSON mapping file")
+	flag.StringVar(&labelAllow, "label-allow", "", "only ship labels whose keys match one of these patterns, separated with ','")
+	flag.StringVar(&labelDeny, "label-deny", "", "never ship labels whose keys match one of these patterns, separated with ','")
+	flag.StringVar(&labelRedact, "label-redact", "", "redact values of labels & environment variables whose keys match one of these patterns, separated with ','")
+	flag.StringVar(&labelRedactMode, "label-redact-mode", config.RedactHash, "how to redact values: hash or mask")
+	flag.IntVar(&labelMaxLength, "label-max-length", 0, "drop label & environment values longer than this many bytes - 0 disables the limit")
+	flag.StringVar(&fieldGroups, "field-groups", "", "optional groups of fields to ship, separated with ',': network (IPs & ports), runtime (image digest, restart count & start time) and host (docker engine name & version)")
+	flag.StringVar(&envCapture, "env", "", "ship container environment variables matching one of these patterns, separated with ','")
+	flag.IntVar(&gracePeriod, "grace-period", 60, "number of seconds to keep shipping stopped containers (unless logstash-forwarder read their log completely) - 0 drops them immediately")
+	flag.BoolVar(&excludeOneOff, "exclude-compose-oneoff", false, "ignore one-off containers created by docker-compose run")
+	flag.Usage = usage
 	flag.Parse()
 }
 
@@ -54,32 +129,248 @@ func main() {
 		setUpLogging(logging.INFO)
 	}
 
-	endpoint := getDockerEndpoint()
-
-	d, err := docker.NewClient(endpoint)
+	schema, err := config.NewSchema(schemaName)
 	if err != nil {
-		log.Fatalf("Unable to connect to docker at %s: %s", endpoint, err)
+		log.Fatalf("Unable to load field schema %s: %s", schemaName, err)
 	}
-	client = d
-	version, err := client.Version()
-	if err != nil {
-		log.Warning("Unable to retrieve version information from docker: %s", err)
+	if labelRedactMode != config.RedactHash && labelRedactMode != config.RedactMask {
+		log.Fatalf("Unknown redact mode %s", labelRedactMode)
+	}
+	metadata = &config.Metadata{
+		Schema: schema,
+		Filter: &config.MetadataFilter{
+			Allow:      splitList(labelAllow),
+			Deny:       splitList(labelDeny),
+			Redact:     splitList(labelRedact),
+			RedactMode: labelRedactMode,
+			MaxLength:  labelMaxLength,
+			Env:        splitList(envCapture),
+		},
+		Groups: make(map[string]bool),
+	}
+	for _, group := range splitList(fieldGroups) {
+		if !contains(config.Groups, group) {
+			log.Fatalf("Unknown field group %s, must be one of %s", group, strings.Join(config.Groups, ", "))
+		}
+		metadata.Groups[group] = true
+	}
+
+	for fileType, paths := range hostFiles {
+		for _, path := range paths {
+			if path == "" {
+				log.Fatalf("No path given for host file of type %s", fileType)
+			}
+		}
+	}
+
+	wrapperConfig = &config.WrapperConfig{}
+	if wrapperFile != "" {
+		if wrapperConfig, err = config.NewWrapperFromFile(wrapperFile); err != nil {
+			log.Fatalf("Unable to read docker-logstash-forwarder config from %s: %s", wrapperFile, err)
+		}
+	}
+	wrapperConfig = withFlags(wrapperConfig)
+
+	if backend, err = forwarder.NewBackend(backendName); err != nil {
+		log.Fatalf("%s", err)
+	}
+	if fragmentsDir != "" && backend.Fragment == nil {
+		log.Fatalf("%s does not support -fragments", backend.Name)
+	}
+
+	if templateFile != "" {
+		if tmpl, err = forwarder.NewTemplateFromFile(templateFile); err != nil {
+			log.Fatalf("Unable to parse template %s: %s", templateFile, err)
+		}
+	}
+
+	checkCommand(flag.Args())
+	if flag.Arg(0) == "debug-receiver" {
+		os.Exit(debugReceiver(flag.Args()[1:]))
+	}
+	if readyAddr != "" && flag.NArg() == 0 {
+		go serveReadiness(readyAddr)
+	}
+
+	timeout := time.Duration(startupTimeout) * time.Second
+	if flag.NArg() > 0 {
+		// commands are run once (i.e. in CI), so they fail right away
+		timeout = 0
+	}
+	daemons = connectDaemons(parseDaemonSpecs(getDockerEndpoint()), timeout)
+	if len(daemons) == 0 {
+		log.Fatalf("No docker endpoint given")
+	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	signals := make(chan os.Signal, 1)
+	notify := shutdownSignals
+	for _, sig := range []os.Signal{reloadSignal, dumpSignal} {
+		if sig != nil {
+			notify = append(notify, sig)
+		}
+	}
+	signal.Notify(signals, notify...)
+
+	if watch {
+		if watcher, err = utils.NewFileWatcher(filesChangedRefresh); err != nil {
+			log.Warning("Unable to watch files: %s", err)
+		}
+	}
+
+	if probe {
+		probeLogstash(refreshOptions())
 	}
-	log.Info("Connected to docker at %s (v%s)", endpoint, version.Get("Version"))
 
 	generateConfig()
-	utils.RegisterDockerEventListener(client, generateConfig, &wg, laziness)
-	wg.Wait()
 
-	log.Info("done")
+	done := make(chan struct{})
+	for _, daemon := range daemons {
+		wg.Add(1)
+		go utils.RegisterDockerEventListener(daemon.Client, generateConfig, &wg, laziness, done)
+	}
+
+	for sig := range signals {
+		switch {
+		case sig == reloadSignal:
+			log.Info("Received %s, reloading configuration", sig)
+			reloadConfig()
+			utils.Refresh.Stop()
+			generateConfig()
+		case sig == dumpSignal:
+			dumpState()
+		default:
+			log.Info("Received %s, shutting down", sig)
+			signal.Stop(signals)
+			utils.Refresh.Stop()
+			close(done)
+			wg.Wait()
+			markUnready()
+			fwd.Shutdown()
+			log.Info("done")
+			return
+		}
+	}
 }
 
+// reloadConfig re-reads -template & -wrapper-config, keeping the current ones if they are invalid.
+// The -config template is re-read on every refresh anyway.
+func reloadConfig() {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if templateFile != "" {
+		if t, err := forwarder.NewTemplateFromFile(templateFile); err != nil {
+			log.Error("Unable to parse template %s, keeping the current one: %s", templateFile, err)
+		} else {
+			tmpl = t
+		}
+	}
+	if wrapperFile != "" {
+		if w, err := config.NewWrapperFromFile(wrapperFile); err != nil {
+			log.Error("Unable to read docker-logstash-forwarder config from %s, keeping the current one: %s", wrapperFile, err)
+		} else {
+			wrapperConfig = withFlags(w)
+		}
+	}
+}
+
+// withFlags adds the -field & -host-file flags to wrapper, -field taking precedence over its fields.
+func withFlags(wrapper *config.WrapperConfig) *config.WrapperConfig {
+	if len(staticFields) > 0 && wrapper.Fields == nil {
+		wrapper.Fields = make(map[string]string)
+	}
+	for k, v := range staticFields {
+		wrapper.Fields[k] = v
+	}
+
+	types := []string{}
+	for fileType := range hostFiles {
+		types = append(types, fileType)
+	}
+	sort.Strings(types)
+	for _, fileType := range types {
+		paths := []string{}
+		for _, list := range hostFiles[fileType] {
+			paths = append(paths, splitList(list)...)
+		}
+		wrapper.Files = append(wrapper.Files, config.HostFile{Paths: paths, Type: fileType})
+	}
+	return wrapper
+}
+
+func dumpState() {
+	utils.Refresh.Mu.Lock()
+	triggered := utils.Refresh.IsTriggered
+	utils.Refresh.Mu.Unlock()
+
+	endpoints := []string{}
+	for _, daemon := range daemons {
+		endpoints = append(endpoints, daemon.Client.Endpoint())
+	}
+	log.Info("Connected to docker at %s, refresh pending: %t", strings.Join(endpoints, ", "), triggered)
+	fwd.DumpState()
+}
+
+// filesChangedRefresh marks the config files as changed, so they are re-read by the next refresh
+// (even if one is pending already), and triggers one.
+func filesChangedRefresh() {
+	atomic.StoreInt32(&filesChanged, 1)
+	utils.Refresh.Trigger(generateConfig, laziness)
+}
+
+// refreshRetryDelay is the number of seconds to wait before retrying a failed refresh.
+const refreshRetryDelay = 10
+
+// generateConfig refreshes the configuration, marking docker-logstash-forwarder as ready once it succeeded.
+// Failed refreshes are retried, keeping the current configuration in the meantime.
 func generateConfig() {
 	log.Info("Triggering refresh...")
 	utils.Refresh.Mu.Lock()
 	utils.Refresh.IsTriggered = false
 	utils.Refresh.Mu.Unlock()
-	forwarder.TriggerRefresh(client, getLogstashEndpoint(), configFile, quiet)
+
+	if atomic.CompareAndSwapInt32(&filesChanged, 1, 0) {
+		reloadConfig()
+	}
+
+	if err := fwd.TriggerRefresh(daemons, refreshOptions()); err != nil {
+		log.Error("Refresh failed, retrying in %d seconds: %s", refreshRetryDelay, err)
+		utils.Refresh.Trigger(generateConfig, refreshRetryDelay)
+		return
+	}
+	markReady()
+
+	if watcher != nil {
+		watcher.Watch(append(fwd.WatchedFiles(), configFile, templateFile, wrapperFile))
+	}
+}
+
+// refreshOptions returns the options to refresh with, based on the flags and config files.
+func refreshOptions() forwarder.Options {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return forwarder.Options{
+		LogstashEndpoint:      getLogstashEndpoint(),
+		ConfigFile:            configFile,
+		Quiet:                 quiet,
+		ExcludeComposeOneOff:  excludeOneOff,
+		Metadata:              metadata,
+		Wrapper:               wrapperConfig,
+		AllowContainerNetwork: allowContainerNetwork,
+		Backend:               backend,
+		Template:              tmpl,
+		Settings:              backendOptions,
+		FragmentsDir:          fragmentsDir,
+		SpoolDir:              spoolDir,
+		GracePeriod:           time.Duration(gracePeriod) * time.Second,
+		OnExpiry:              func() { utils.Refresh.Trigger(generateConfig, 0) },
+		OnExit:                func() { utils.Refresh.Trigger(generateConfig, refreshRetryDelay) },
+		StateDir:              stateDir,
+		ConfigDir:             configDir,
+	}
 }
 
 func getDockerEndpoint() string {
@@ -89,3 +380,19 @@ func getDockerEndpoint() string {
 func getLogstashEndpoint() string {
 	return utils.EndPoint("logstash:5043", logstashEndPoint, "LOGSTASH_HOST")
 }
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
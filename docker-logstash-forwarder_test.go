@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+	"github.com/digital-wonderland/docker-logstash-forwarder/utils"
+)
+
+func TestWithFlagsCombinesHostFiles(t *testing.T) {
+	defer func() { hostFiles = utils.ListMapFlag{} }()
+	for _, value := range []string{"syslog=/var/log/syslog", "nginx=/var/log/nginx/*.log", "syslog=/var/log/auth.log,/var/log/kern.log"} {
+		if err := hostFiles.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wrapper := withFlags(&config.WrapperConfig{})
+	want := []config.HostFile{
+		{Paths: []string{"/var/log/nginx/*.log"}, Type: "nginx"},
+		{Paths: []string{"/var/log/syslog", "/var/log/auth.log", "/var/log/kern.log"}, Type: "syslog"},
+	}
+	if !reflect.DeepEqual(wrapper.Files, want) {
+		t.Errorf("got host files %+v, want %+v", wrapper.Files, want)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder"
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+	"github.com/digital-wonderland/docker-logstash-forwarder/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// daemonSpec is a single entry of -docker: [name=]endpoint[@/local/data/root].
+type daemonSpec struct {
+	name     string
+	endpoint string
+	root     string
+}
+
+// parseDaemonSpecs splits the comma separated list of docker endpoints.
+//
+// The data root is separated at the last "@/", so endpoints containing user info keep working.
+func parseDaemonSpecs(list string) []daemonSpec {
+	specs := []daemonSpec{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		spec := daemonSpec{}
+		if i := strings.Index(entry, "="); i >= 0 && !strings.Contains(entry[:i], "/") {
+			spec.name, entry = entry[:i], entry[i+1:]
+		}
+		if i := strings.LastIndex(entry, "@/"); i >= 0 {
+			spec.root, entry = entry[i+1:], entry[:i]
+		}
+		spec.endpoint = entry
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// connectDaemons connects to every daemon in specs, retrying for up to timeout and exiting
+// if any of them is still unusable afterwards.
+//
+// Daemons are only named if explicitly given a name or if watching more than one daemon,
+// in which case the name reported by docker is used.
+func connectDaemons(specs []daemonSpec, timeout time.Duration) []*forwarder.Daemon {
+	daemons := []*forwarder.Daemon{}
+	for _, spec := range specs {
+		var daemon *forwarder.Daemon
+		err := utils.Retry("Connecting to docker at "+spec.endpoint, timeout, func() (err error) {
+			daemon, err = connectDaemon(spec, len(specs) > 1)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Unable to connect to docker at %s: %s", spec.endpoint, err)
+		}
+		daemons = append(daemons, daemon)
+	}
+	return daemons
+}
+
+func connectDaemon(spec daemonSpec, multiple bool) (*forwarder.Daemon, error) {
+	client, err := newDockerClient(spec.endpoint)
+	if err != nil {
+		log.Fatalf("Unable to connect to docker at %s: %s", spec.endpoint, err)
+	}
+	version, err := client.Version()
+	if err != nil {
+		if isTLSError(err) {
+			log.Fatalf("TLS handshake with docker at %s failed (check -docker-cert, -docker-key & -docker-ca or $DOCKER_CERT_PATH): %s", spec.endpoint, err)
+		}
+		return nil, err
+	}
+
+	daemon := &forwarder.Daemon{Name: spec.name, Client: client}
+	if spec.root != "" || (spec.name == "" && multiple) || metadata.Groups[config.GroupHost] {
+		info, err := client.Info()
+		if err != nil {
+			return nil, err
+		}
+		daemon.Info = info
+		if daemon.Name == "" && multiple {
+			daemon.Name = info.Name
+			if daemon.Name == "" {
+				daemon.Name = spec.endpoint
+			}
+		}
+		if spec.root != "" {
+			daemon.DataRoot = config.DataRoot{Daemon: info.DockerRootDir, Local: spec.root}
+		}
+	}
+
+	log.Info("Connected to docker at %s (v%s)", spec.endpoint, version.Get("Version"))
+	return daemon, nil
+}
+
+// newDockerClient returns a client for endpoint, using TLS if $DOCKER_TLS_VERIFY is set or
+// any of -docker-cert, -docker-key or -docker-ca is passed.
+//
+// The certificate of docker is only verified if $DOCKER_TLS_VERIFY is set or -docker-ca is passed.
+func newDockerClient(endpoint string) (*docker.Client, error) {
+	apiVersion := utils.EndPoint("", dockerAPIVersion, "DOCKER_API_VERSION")
+
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		certPath = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	cert := utils.EndPoint(filepath.Join(certPath, "cert.pem"), dockerCert, "")
+	key := utils.EndPoint(filepath.Join(certPath, "key.pem"), dockerKey, "")
+	ca := utils.EndPoint(filepath.Join(certPath, "ca.pem"), dockerCA, "")
+
+	if os.Getenv("DOCKER_TLS_VERIFY") == "" && dockerCert == "" && dockerKey == "" && dockerCA == "" {
+		return docker.NewVersionedClient(endpoint, apiVersion)
+	}
+
+	files := []string{cert, key}
+	if os.Getenv("DOCKER_TLS_VERIFY") != "" || dockerCA != "" {
+		files = append(files, ca)
+	} else {
+		log.Warning("Not verifying the certificate of docker, since neither $DOCKER_TLS_VERIFY nor -docker-ca is set")
+		ca = ""
+	}
+	for _, path := range files {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("Unable to use TLS: %s", err)
+		}
+	}
+
+	log.Info("Using TLS to connect to docker (cert: %s, key: %s, ca: %s)", cert, key, ca)
+	return docker.NewVersionedTLSClient(endpoint, cert, key, ca, apiVersion)
+}
+
+// isTLSError reports whether err was caused by a failed TLS handshake.
+func isTLSError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+		return true
+	}
+	return strings.Contains(err.Error(), "tls:")
+}
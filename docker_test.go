@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDaemonSpecs(t *testing.T) {
+	tests := []struct {
+		list string
+		want []daemonSpec
+	}{
+		{"", []daemonSpec{}},
+		{"unix:///var/run/docker.sock", []daemonSpec{{endpoint: "unix:///var/run/docker.sock"}}},
+		{"prod=tcp://10.0.0.1:2376", []daemonSpec{{name: "prod", endpoint: "tcp://10.0.0.1:2376"}}},
+		{"prod=tcp://10.0.0.1:2376@/mnt/prod", []daemonSpec{{name: "prod", endpoint: "tcp://10.0.0.1:2376", root: "/mnt/prod"}}},
+		{"tcp://user@10.0.0.1:2376", []daemonSpec{{endpoint: "tcp://user@10.0.0.1:2376"}}},
+		{"tcp://user@10.0.0.1:2376@/mnt/prod", []daemonSpec{{endpoint: "tcp://user@10.0.0.1:2376", root: "/mnt/prod"}}},
+		{"unix:///run/a=b.sock", []daemonSpec{{endpoint: "unix:///run/a=b.sock"}}},
+		{"a=unix:///run/a.sock@/mnt/x=y", []daemonSpec{{name: "a", endpoint: "unix:///run/a.sock", root: "/mnt/x=y"}}},
+		{" a=tcp://h:1 ,, b=tcp://h:2@/mnt/b ,", []daemonSpec{
+			{name: "a", endpoint: "tcp://h:1"},
+			{name: "b", endpoint: "tcp://h:2", root: "/mnt/b"},
+		}},
+	}
+	for _, test := range tests {
+		if got := parseDaemonSpecs(test.list); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseDaemonSpecs(%q) = %+v, want %+v", test.list, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Package fakedocker implements a fake docker daemon serving scripted containers & events
+// via HTTP over a unix socket - just enough of the API for docker-logstash-forwarder.
+//
+//	daemon, _ := fakedocker.NewServer("/tmp/docker.sock")
+//	defer daemon.Close()
+//	client, _ := docker.NewClient(daemon.URL())
+//	daemon.Start(&docker.Container{ID: "abc", Name: "/web", Config: &docker.Config{}, Driver: "overlay"})
+//	daemon.Die("abc")
+package fakedocker
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// APIVersion is the API version the fake daemon reports.
+const APIVersion = "1.25"
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+// Server is a fake docker daemon.
+type Server struct {
+	socket   string
+	listener net.Listener
+
+	mu          sync.Mutex
+	containers  map[string]*docker.Container
+	order       []string
+	images      map[string]*docker.Image
+	subscribers map[chan docker.APIEvents]bool
+}
+
+// NewServer starts serving on a unix socket at path, replacing any existing file.
+func NewServer(path string) (*Server, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		socket:      path,
+		listener:    listener,
+		containers:  make(map[string]*docker.Container),
+		images:      make(map[string]*docker.Image),
+		subscribers: make(map[chan docker.APIEvents]bool),
+	}
+	go http.Serve(listener, server)
+	return server, nil
+}
+
+// URL returns the endpoint to connect to.
+func (server *Server) URL() string {
+	return "unix://" + server.socket
+}
+
+// Close stops serving and ends all event streams.
+func (server *Server) Close() error {
+	server.mu.Lock()
+	for events := range server.subscribers {
+		close(events)
+		delete(server.subscribers, events)
+	}
+	server.mu.Unlock()
+
+	err := server.listener.Close()
+	os.Remove(server.socket)
+	return err
+}
+
+// AddImage adds image, which can be inspected by its ID.
+func (server *Server) AddImage(image *docker.Image) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.images[image.ID] = image
+}
+
+// Create adds container without starting it.
+func (server *Server) Create(container *docker.Container) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if _, ok := server.containers[container.ID]; !ok {
+		server.order = append(server.order, container.ID)
+	}
+	if container.Created.IsZero() {
+		container.Created = time.Now()
+	}
+	server.containers[container.ID] = container
+	server.emit("create", container)
+}
+
+// Start adds container if unknown, marks it running and emits a start event.
+func (server *Server) Start(container *docker.Container) {
+	server.mu.Lock()
+	_, ok := server.containers[container.ID]
+	server.mu.Unlock()
+	if !ok {
+		server.Create(container)
+	}
+	server.setState(container.ID, true, "start")
+}
+
+// Stop marks the container as exited and emits a die followed by a stop event,
+// as docker does on `docker stop`.
+func (server *Server) Stop(id string) {
+	server.setState(id, false, "die")
+	server.Emit("stop", id)
+}
+
+// Die marks the container as exited and emits a die event, as if it crashed.
+func (server *Server) Die(id string) {
+	server.setState(id, false, "die")
+}
+
+// Destroy removes the container and emits a destroy event.
+func (server *Server) Destroy(id string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	container, ok := server.containers[id]
+	if !ok {
+		return
+	}
+	delete(server.containers, id)
+	for i, known := range server.order {
+		if known == id {
+			server.order = append(server.order[:i], server.order[i+1:]...)
+			break
+		}
+	}
+	server.emit("destroy", container)
+}
+
+// Emit sends an event with status for the container with id to all event listeners.
+func (server *Server) Emit(status string, id string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if container, ok := server.containers[id]; ok {
+		server.emit(status, container)
+	}
+}
+
+func (server *Server) setState(id string, running bool, status string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	container, ok := server.containers[id]
+	if !ok {
+		return
+	}
+	container.State.Running = running
+	if running {
+		container.State.StartedAt = time.Now()
+	} else {
+		container.State.FinishedAt = time.Now()
+	}
+	server.emit(status, container)
+}
+
+// emit has to be called with mu held.
+func (server *Server) emit(status string, container *docker.Container) {
+	image := ""
+	if container.Config != nil {
+		image = container.Config.Image
+	}
+	now := time.Now()
+	event := docker.APIEvents{
+		Status:   status,
+		ID:       container.ID,
+		From:     image,
+		Type:     "container",
+		Action:   status,
+		Actor:    docker.APIActor{ID: container.ID},
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}
+	for events := range server.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "")
+	switch {
+	case path == "/_ping":
+		w.Write([]byte("OK"))
+	case path == "/version":
+		writeJSON(w, map[string]string{"Version": "fake", "ApiVersion": APIVersion, "Os": "linux"})
+	case path == "/info":
+		server.mu.Lock()
+		containers := len(server.containers)
+		server.mu.Unlock()
+		hostname, _ := os.Hostname()
+		writeJSON(w, docker.DockerInfo{Name: hostname, DockerRootDir: "/var/lib/docker", Containers: containers})
+	case path == "/containers/json":
+		server.listContainers(w, r)
+	case strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+		server.inspectContainer(w, strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/json"))
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		server.inspectImage(w, strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json"))
+	case path == "/events":
+		server.streamEvents(w, r)
+	default:
+		http.Error(w, "not implemented by fakedocker", http.StatusNotFound)
+	}
+}
+
+func (server *Server) listContainers(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "1" || r.URL.Query().Get("all") == "true"
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	containers := []docker.APIContainers{}
+	for _, id := range server.order {
+		container := server.containers[id]
+		if !all && !container.State.Running {
+			continue
+		}
+		c := docker.APIContainers{ID: container.ID, Names: []string{container.Name}, Created: container.Created.Unix()}
+		if container.Config != nil {
+			c.Image = container.Config.Image
+			c.Labels = container.Config.Labels
+		}
+		c.State = container.State.StateString()
+		c.Status = container.State.String()
+		containers = append(containers, c)
+	}
+	writeJSON(w, containers)
+}
+
+func (server *Server) inspectContainer(w http.ResponseWriter, name string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for _, id := range server.order {
+		container := server.containers[id]
+		if id == name || strings.HasPrefix(id, name) || strings.TrimPrefix(container.Name, "/") == strings.TrimPrefix(name, "/") {
+			writeJSON(w, container)
+			return
+		}
+	}
+	http.Error(w, "No such container: "+name, http.StatusNotFound)
+}
+
+func (server *Server) inspectImage(w http.ResponseWriter, id string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if image, ok := server.images[id]; ok {
+		writeJSON(w, image)
+		return
+	}
+	http.Error(w, "No such image: "+id, http.StatusNotFound)
+}
+
+func (server *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	events := make(chan docker.APIEvents, 64)
+	server.mu.Lock()
+	server.subscribers[events] = true
+	server.mu.Unlock()
+
+	defer func() {
+		server.mu.Lock()
+		if server.subscribers[events] {
+			delete(server.subscribers, events)
+		}
+		server.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
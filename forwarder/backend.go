@@ -0,0 +1,124 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+// Backend is a log shipper which can be configured & supervised.
+type Backend struct {
+	Name string
+	// Template renders the shippers config for a destination.
+	Template *template.Template
+	// Command returns the command running the shipper with the config at path.
+	Command func(path string, quiet bool) *exec.Cmd
+	// Fragment renders the config of a single container, nil if the shipper does not support fragments.
+	Fragment          *template.Template
+	FragmentExtension string
+	// Reload is sent to the shipper after fragments changed, nil if it watches them by itself.
+	Reload os.Signal
+	// Registry returns how far the shipper running in dir read every file, nil if unknown.
+	Registry func(dir string) map[string]int64
+}
+
+var backends = map[string]*Backend{
+	"logstash-forwarder": {
+		Name:     "logstash-forwarder",
+		Template: DefaultTemplate,
+		Command: func(path string, quiet bool) *exec.Cmd {
+			return exec.Command("logstash-forwarder", "-config", path, fmt.Sprintf("-quiet=%t", quiet))
+		},
+		Registry: logstashForwarderRegistry,
+	},
+	"fluent-bit": {
+		Name:     "fluent-bit",
+		Template: fluentBitTemplate,
+		Command: func(path string, quiet bool) *exec.Cmd {
+			if quiet {
+				return exec.Command("fluent-bit", "-q", "-c", path)
+			}
+			return exec.Command("fluent-bit", "-c", path)
+		},
+		Fragment:          fluentBitFragmentTemplate,
+		FragmentExtension: ".conf",
+		Reload:            syscall.SIGHUP,
+	},
+	"promtail": {
+		Name:     "promtail",
+		Template: promtailTemplate,
+		Command: func(path string, quiet bool) *exec.Cmd {
+			if quiet {
+				return exec.Command("promtail", "-config.file="+path, "-log.level=warn")
+			}
+			return exec.Command("promtail", "-config.file="+path)
+		},
+		Fragment:          promtailFragmentTemplate,
+		FragmentExtension: ".json",
+	},
+}
+
+// DefaultBackend is logstash-forwarder.
+var DefaultBackend = backends["logstash-forwarder"]
+
+// NewBackend returns the backend called name.
+func NewBackend(name string) (*Backend, error) {
+	if backend, ok := backends[name]; ok {
+		return backend, nil
+	}
+
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("Unknown backend %s, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// logstashForwarderRegistry reads the offsets from .logstash-forwarder in dir, the working directory
+// logstash-forwarder keeps track of what it shipped in.
+func logstashForwarderRegistry(dir string) map[string]int64 {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ".logstash-forwarder"))
+	if err != nil {
+		return nil
+	}
+	var states map[string]struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := json.Unmarshal(content, &states); err != nil {
+		log.Warning("Unable to parse logstash-forwarder registry: %s", err)
+		return nil
+	}
+	registry := make(map[string]int64, len(states))
+	for path, state := range states {
+		registry[path] = state.Offset
+	}
+	return registry
+}
+
+// registry merges the registries of all backend instances running below stateDir.
+func (backend *Backend) registry(stateDir string) map[string]int64 {
+	entries, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return nil
+	}
+	registry := make(map[string]int64)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		for path, offset := range backend.Registry(filepath.Join(stateDir, entry.Name())) {
+			if offset > registry[path] {
+				registry[path] = offset
+			}
+		}
+	}
+	return registry
+}
@@ -4,7 +4,9 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -13,6 +15,21 @@ import (
 
 var log = logging.MustGetLogger("config")
 
+// Labels set by docker-compose on every container it creates.
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	composeNumberLabel  = "com.docker.compose.container-number"
+	composeOneOffLabel  = "com.docker.compose.oneoff"
+)
+
+// Labels controlling how a containers docker log file gets shipped.
+const (
+	TypeLabel          = "logstash-forwarder.type"
+	CodecLabel         = "logstash-forwarder.codec"
+	SkipDockerLogLabel = "logstash-forwarder.skip-docker-log"
+)
+
 // Network section of a configuration.
 type Network struct {
 	Servers        []string `json:"servers"`
@@ -20,50 +37,152 @@ type Network struct {
 	SslKey         string   `json:"ssl key"`
 	SslCa          string   `json:"ssl ca"`
 	Timeout        int64    `json:"timeout"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // File section of a configuration.
 type File struct {
-	Paths  []string          `json:"paths"`
-	Fields map[string]string `json:"fields"`
+	Paths    []string          `json:"paths"`
+	Fields   map[string]string `json:"fields"`
+	DeadTime string            `json:"dead time,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// IsSet reports whether the network section configures anything, i.e. servers or ssl files.
+func (network *Network) IsSet() bool {
+	return len(network.Servers) > 0 || len(network.SslFiles()) > 0 || network.Timeout != 0 || len(network.Extra) > 0
+}
+
+// Validate checks that servers are configured, all of them are valid host:port pairs and all
+// configured ssl files exist.
+func (network *Network) Validate() error {
+	if len(network.Servers) == 0 {
+		return fmt.Errorf("No servers configured")
+	}
+	for _, server := range network.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("Invalid server %s: %s", server, err)
+		}
+	}
+	for _, path := range network.SslFiles() {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SslFiles returns the paths of all configured ssl files.
+func (network *Network) SslFiles() []string {
+	files := []string{}
+	for _, path := range []string{network.SslCertificate, network.SslKey, network.SslCa} {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// resolvePaths expands the ssl file paths to be valid within this container.
+func (network *Network) resolvePaths(container *docker.Container, root DataRoot) {
+	for _, path := range []*string{&network.SslCertificate, &network.SslKey, &network.SslCa} {
+		if *path == "" {
+			continue
+		}
+		filePath, err := calculateFilePath(container, root, *path)
+		if err != nil {
+			log.Warning("Unable to resolve %s: %s", *path, err)
+		} else {
+			*path = filePath
+		}
+	}
 }
 
 // LogstashForwarderConfig is the configs root structure.
 type LogstashForwarderConfig struct {
 	Network Network `json:"network"`
 	Files   []File  `json:"files"`
+
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
 // AddContainerLogFile adds the containers docker log file to this config.
-func (config *LogstashForwarderConfig) AddContainerLogFile(container *docker.Container) {
-	id := container.ID
+func (config *LogstashForwarderConfig) AddContainerLogFile(container *docker.Container, root DataRoot, metadata *Metadata) {
+	if file, ok := NewContainerLogFile(container, root, metadata); ok {
+		config.Files = append(config.Files, file)
+	}
+}
+
+// NewContainerLogFile returns the file section for the containers docker log file.
+//
+// type and codec default to docker and json but can be overridden via container labels,
+// no file is returned if the container is labeled with logstash-forwarder.skip-docker-log=true.
+func NewContainerLogFile(container *docker.Container, root DataRoot, metadata *Metadata) (File, bool) {
+	labels := container.Config.Labels
+	if strings.EqualFold(labels[SkipDockerLogLabel], "true") {
+		log.Debug("Skipping docker log file of %s", container.ID)
+		return File{}, false
+	}
+
 	file := File{}
-	file.Paths = []string{fmt.Sprintf("/var/lib/docker/containers/%s/%s-json.log", id, id)}
-	file.Fields = make(map[string]string)
-	file.Fields["type"] = "docker"
-	file.Fields["codec"] = "json"
-	file.Fields["docker/id"] = id
-	file.Fields["docker/hostname"] = container.Config.Hostname
-	file.Fields["docker/name"] = container.Name
-	file.Fields["docker/image"] = container.Config.Image
-
-	for k, v := range container.Config.Labels {
-		k = strings.Replace(k, ".", "-", -1)
-		file.Fields["docker/label/"+k] = v
-	}
-
-	if container.Node != nil {
-		file.Fields["docker/node/id"] = container.Node.ID
-		file.Fields["docker/node/ip"] = container.Node.IP
-		file.Fields["docker/node/name"] = container.Node.Name
-
-		for k, v := range container.Node.Labels {
-			k = strings.Replace(k, ".", "-", -1)
-			file.Fields["docker/node/label/"+k] = v
-		}
+	file.Paths = ContainerLogPaths(container, root)
+	file.Fields = metadata.Fields(container)
+	file.Fields["type"] = labelOrDefault(labels, TypeLabel, "docker")
+	file.Fields["codec"] = labelOrDefault(labels, CodecLabel, "json")
+	return file, true
+}
+
+// ContainerLogPath returns the path of the containers docker log file.
+func ContainerLogPath(container *docker.Container, root DataRoot) string {
+	id := container.ID
+	return root.Map(fmt.Sprintf("%s/containers/%s/%s-json.log", root.daemon(), id, id))
+}
+
+// ContainerLogPaths returns the path of the containers docker log file followed by the paths of
+// all rotated files the json-file log driver keeps with --log-opt max-file.
+//
+// Compressed rotations (--log-opt compress=true gzips all but the most recent rotation to .gz) are skipped,
+// since they can not be shipped as is.
+func ContainerLogPaths(container *docker.Container, root DataRoot) []string {
+	path := ContainerLogPath(container, root)
+	paths := []string{path}
+	if container.HostConfig == nil {
+		return paths
 	}
 
-	config.Files = append(config.Files, file)
+	logConfig := container.HostConfig.LogConfig
+	if logConfig.Type != "" && logConfig.Type != "json-file" {
+		log.Debug("%s uses the %s log driver, its docker log file probably does not exist", container.ID, logConfig.Type)
+		return paths
+	}
+	maxFile, err := strconv.Atoi(logConfig.Config["max-file"])
+	if err != nil || maxFile < 2 {
+		return paths
+	}
+
+	rotations := maxFile - 1
+	if strings.EqualFold(logConfig.Config["compress"], "true") {
+		log.Debug("Skipping compressed rotations of the docker log file of %s", container.ID)
+		rotations = 1
+	}
+	for i := 1; i <= rotations; i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", path, i))
+	}
+	return paths
+}
+
+func labelOrDefault(labels map[string]string, key string, sensibleDefault string) string {
+	if v := labels[key]; v != "" {
+		return v
+	}
+	return sensibleDefault
+}
+
+// IsComposeOneOff reports whether the container was created by `docker-compose run`.
+func IsComposeOneOff(container *docker.Container) bool {
+	return strings.EqualFold(container.Config.Labels[composeOneOffLabel], "true")
 }
 
 // NewFromFile returns a new config based on the file at path.
@@ -104,8 +223,10 @@ func NewFromDefault(logstashEndpoint string) *LogstashForwarderConfig {
 
 // NewFromContainer returns a new config based on /etc/logstash-forwarder.conf within the container,
 // if it exists.
-func NewFromContainer(container *docker.Container) (*LogstashForwarderConfig, error) {
-	filePath, err := calculateFilePath(container, "/etc/logstash-forwarder.conf")
+//
+// File paths, as well as the ssl file paths of a network section, are expanded to be valid within this container.
+func NewFromContainer(container *docker.Container, root DataRoot) (*LogstashForwarderConfig, error) {
+	filePath, err := calculateFilePath(container, root, "/etc/logstash-forwarder.conf")
 	if err != nil {
 		return nil, err
 	}
@@ -117,10 +238,14 @@ func NewFromContainer(container *docker.Container) (*LogstashForwarderConfig, er
 	}
 	log.Debug("Found logstash-forwarder config in %s", container.ID)
 
+	if config.Network.IsSet() {
+		config.Network.resolvePaths(container, root)
+	}
+
 	for _, file := range config.Files {
 		log.Debug("Adding files %s of type %s", file.Paths, file.Fields["type"])
 		for i, path := range file.Paths {
-			filePath, err := calculateFilePath(container, path)
+			filePath, err := calculateFilePath(container, root, path)
 			if err != nil {
 				log.Warning("Unable to add log file: %s", err)
 			} else {
@@ -131,17 +256,22 @@ func NewFromContainer(container *docker.Container) (*LogstashForwarderConfig, er
 	return config, nil
 }
 
-func calculateFilePath(container *docker.Container, path string) (string, error) {
+// ResolvePath expands path within the container to be valid within this container.
+func ResolvePath(container *docker.Container, root DataRoot, path string) (string, error) {
+	return calculateFilePath(container, root, path)
+}
+
+func calculateFilePath(container *docker.Container, root DataRoot, path string) (string, error) {
 	for k, v := range container.Volumes {
 		if strings.HasPrefix(path, k) {
-			return v + strings.TrimPrefix(path, k), nil
+			return root.Map(v + strings.TrimPrefix(path, k)), nil
 		}
 	}
 
 	if container.Driver == "overlay2" {
-		return container.GraphDriver.Data["MergedDir"], nil
+		return root.Map(container.GraphDriver.Data["MergedDir"] + path), nil
 	} else {
-		var prefix = "/var/lib/docker/"
+		var prefix = root.daemon() + "/"
 		var suffix = ""
 
 		switch container.Driver {
@@ -158,6 +288,6 @@ func calculateFilePath(container *docker.Container, path string) (string, error)
 		default:
 			return "", fmt.Errorf("Unable to calculate file path with unknown driver [%s]", container.Driver)
 		}
-		return fmt.Sprintf("%s/%s%s%s", prefix, container.ID, suffix, path), nil
+		return root.Map(fmt.Sprintf("%s/%s%s%s", prefix, container.ID, suffix, path)), nil
 	}
 }
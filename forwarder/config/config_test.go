@@ -0,0 +1,149 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestConfigRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// out is the expected JSON, in if empty.
+		out string
+	}{
+		{"known keys", `{"network": {"servers": ["a:1"], "ssl certificate": "", "ssl key": "", "ssl ca": "", "timeout": 15},
+			"files": [{"paths": ["/a"], "fields": {"type": "x"}, "dead time": "1h"}]}`, ""},
+		{"unknown keys in every section", `{"network": {"servers": ["a:1"], "ssl certificate": "", "ssl key": "", "ssl ca": "", "timeout": 0, "ssl strict verify": true},
+			"files": [{"paths": ["/a"], "fields": null, "codec": {"name": "multiline"}}], "max line bytes": 1024}`, ""},
+		{"dead time omitted if empty", `{"network": {"servers": null, "ssl certificate": "", "ssl key": "", "ssl ca": "", "timeout": 0},
+			"files": [{"paths": ["/a"], "fields": {}, "dead time": ""}]}`,
+			`{"network": {"servers": null, "ssl certificate": "", "ssl key": "", "ssl ca": "", "timeout": 0},
+			"files": [{"paths": ["/a"], "fields": {}}]}`},
+	}
+	for _, test := range tests {
+		var config LogstashForwarderConfig
+		if err := json.Unmarshal([]byte(test.in), &config); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		out, err := json.Marshal(config)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		want := test.out
+		if want == "" {
+			want = test.in
+		}
+		assertJSONEqual(t, test.name, out, []byte(want))
+	}
+}
+
+func TestExtraDoesNotOverrideKnownKeys(t *testing.T) {
+	file := File{Paths: []string{"/a"}, Extra: map[string]json.RawMessage{"paths": json.RawMessage(`["/b"]`), "codec": json.RawMessage(`"json"`)}}
+	out, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSONEqual(t, "file", out, []byte(`{"paths": ["/a"], "fields": null, "codec": "json"}`))
+}
+
+func TestUnknownKeysAreReportedOnce(t *testing.T) {
+	for i, want := range []bool{true, false} {
+		if got := report("test", "codec"); got != want {
+			t.Errorf("report #%d = %t, want %t", i+1, got, want)
+		}
+	}
+	if !report("other", "codec") {
+		t.Error("key of another section was not reported")
+	}
+}
+
+func assertJSONEqual(t *testing.T, name string, got []byte, want []byte) {
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	if err := json.Unmarshal(want, &w); err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("%s: got %s, want %s", name, got, want)
+	}
+}
+
+func TestNetworkValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		network Network
+		set     bool
+		valid   bool
+	}{
+		{"empty", Network{}, false, false},
+		{"servers", Network{Servers: []string{"logstash:5043"}}, true, true},
+		{"ssl only", Network{SslCa: "/etc/hosts"}, true, false},
+		{"timeout only", Network{Timeout: 15}, true, false},
+		{"invalid server", Network{Servers: []string{"logstash"}}, true, false},
+		{"missing ssl file", Network{Servers: []string{"logstash:5043"}, SslCa: "/does/not/exist"}, true, false},
+	}
+	for _, test := range tests {
+		if set := test.network.IsSet(); set != test.set {
+			t.Errorf("%s: IsSet() = %t, want %t", test.name, set, test.set)
+		}
+		if err := test.network.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestDataRootMap(t *testing.T) {
+	tests := []struct {
+		root DataRoot
+		path string
+		want string
+	}{
+		{DataRoot{}, "/var/lib/docker/containers/a/a-json.log", "/var/lib/docker/containers/a/a-json.log"},
+		{DataRoot{Local: "/mnt/a"}, "/var/lib/docker/containers/a/a-json.log", "/mnt/a/containers/a/a-json.log"},
+		{DataRoot{Local: "/mnt/a"}, "/var/lib/docker", "/mnt/a"},
+		{DataRoot{Local: "/mnt/a"}, "/var/lib/docker-other/x", "/var/lib/docker-other/x"},
+		{DataRoot{Local: "/mnt/a"}, "/etc/hosts", "/etc/hosts"},
+		{DataRoot{Daemon: "/data/docker/", Local: "/mnt/b"}, "/data/docker/overlay2/x/merged/log", "/mnt/b/overlay2/x/merged/log"},
+		{DataRoot{Daemon: "/data/docker", Local: "/mnt/b"}, "/var/lib/docker/containers/a", "/var/lib/docker/containers/a"},
+	}
+	for _, test := range tests {
+		if got := test.root.Map(test.path); got != test.want {
+			t.Errorf("%+v.Map(%q) = %q, want %q", test.root, test.path, got, test.want)
+		}
+	}
+}
+
+func TestContainerLogPaths(t *testing.T) {
+	const path = "/var/lib/docker/containers/abc/abc-json.log"
+	logConfig := func(logType string, config map[string]string) *docker.HostConfig {
+		return &docker.HostConfig{LogConfig: docker.LogConfig{Type: logType, Config: config}}
+	}
+	tests := []struct {
+		name       string
+		hostConfig *docker.HostConfig
+		want       []string
+	}{
+		{"no host config", nil, []string{path}},
+		{"no max-file", logConfig("json-file", nil), []string{path}},
+		{"max-file 1", logConfig("json-file", map[string]string{"max-file": "1"}), []string{path}},
+		{"invalid max-file", logConfig("json-file", map[string]string{"max-file": "three"}), []string{path}},
+		{"max-file 3", logConfig("json-file", map[string]string{"max-file": "3"}), []string{path, path + ".1", path + ".2"}},
+		{"default driver", logConfig("", map[string]string{"max-file": "2"}), []string{path, path + ".1"}},
+		{"compressed", logConfig("json-file", map[string]string{"max-file": "5", "compress": "true"}), []string{path, path + ".1"}},
+		{"other driver", logConfig("journald", map[string]string{"max-file": "3"}), []string{path}},
+	}
+	for _, test := range tests {
+		container := &docker.Container{ID: "abc", HostConfig: test.hostConfig}
+		if got := ContainerLogPaths(container, DataRoot{}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
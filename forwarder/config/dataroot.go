@@ -0,0 +1,40 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// DefaultDataRoot is where docker stores its data by default.
+const DefaultDataRoot = "/var/lib/docker"
+
+// DataRoot maps the data directory of a docker daemon to the path it is available at locally,
+// i.e. for daemons on other hosts whose data directory is mounted via NFS.
+type DataRoot struct {
+	// Daemon is the data directory as reported by the daemon, DefaultDataRoot if empty.
+	Daemon string
+	// Local is the path Daemon is available at locally, no mapping happens if empty.
+	Local string
+}
+
+func (root DataRoot) daemon() string {
+	if root.Daemon == "" {
+		return DefaultDataRoot
+	}
+	return root.Daemon
+}
+
+// Map returns the local path of path, which is valid on the daemons host.
+func (root DataRoot) Map(path string) string {
+	if root.Local == "" {
+		return path
+	}
+	daemon := filepath.Clean(root.daemon())
+	if path == daemon {
+		return root.Local
+	}
+	if strings.HasPrefix(path, daemon+"/") {
+		return filepath.Join(root.Local, strings.TrimPrefix(path, daemon))
+	}
+	return path
+}
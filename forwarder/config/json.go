@@ -0,0 +1,119 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Keys unknown to this package are kept in the Extra map of the section they appear in
+// and written back verbatim, so templates can use options of newer logstash-forwarder versions.
+
+// reported remembers the unknown keys warned about per section, since configs are parsed on every refresh.
+var reported = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: make(map[string]bool)}
+
+// report reports whether key of section is unknown for the first time.
+func report(section string, key string) bool {
+	reported.Lock()
+	defer reported.Unlock()
+	if reported.keys[section+"/"+key] {
+		return false
+	}
+	reported.keys[section+"/"+key] = true
+	return true
+}
+
+type plainNetwork Network
+type plainFile File
+type plainConfig LogstashForwarderConfig
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (network *Network) UnmarshalJSON(data []byte) (err error) {
+	if err = json.Unmarshal(data, (*plainNetwork)(network)); err != nil {
+		return err
+	}
+	network.Extra, err = unknownKeys(data, plainNetwork{}, "network")
+	return err
+}
+
+// MarshalJSON implements json.Marshaler.
+func (network Network) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(plainNetwork(network), network.Extra)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (file *File) UnmarshalJSON(data []byte) (err error) {
+	if err = json.Unmarshal(data, (*plainFile)(file)); err != nil {
+		return err
+	}
+	file.Extra, err = unknownKeys(data, plainFile{}, "files")
+	return err
+}
+
+// MarshalJSON implements json.Marshaler.
+func (file File) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(plainFile(file), file.Extra)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (config *LogstashForwarderConfig) UnmarshalJSON(data []byte) (err error) {
+	if err = json.Unmarshal(data, (*plainConfig)(config)); err != nil {
+		return err
+	}
+	config.Extra, err = unknownKeys(data, plainConfig{}, "root")
+	return err
+}
+
+// MarshalJSON implements json.Marshaler.
+func (config LogstashForwarderConfig) MarshalJSON() ([]byte, error) {
+	return marshalWithExtra(plainConfig(config), config.Extra)
+}
+
+// unknownKeys returns all keys of the JSON object data which do not map to a field of section.
+func unknownKeys(data []byte, section interface{}, name string) (map[string]json.RawMessage, error) {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	t := reflect.TypeOf(section)
+	for i := 0; i < t.NumField(); i++ {
+		if key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; key != "-" {
+			delete(all, key)
+		}
+	}
+
+	if len(all) == 0 {
+		return nil, nil
+	}
+	for key := range all {
+		if report(name, key) {
+			log.Warning("Unknown key \"%s\" in %s section, passing it on as is", key, name)
+		} else {
+			log.Debug("Unknown key \"%s\" in %s section, passing it on as is", key, name)
+		}
+	}
+	return all, nil
+}
+
+func marshalWithExtra(section interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	j, err := json.Marshal(section)
+	if err != nil || len(extra) == 0 {
+		return j, err
+	}
+
+	var all map[string]json.RawMessage
+	if err = json.Unmarshal(j, &all); err != nil {
+		return nil, err
+	}
+	for key, value := range extra {
+		if _, ok := all[key]; !ok {
+			all[key] = value
+		}
+	}
+	return json.Marshal(all)
+}
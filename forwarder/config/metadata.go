@@ -0,0 +1,226 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Redaction modes of a MetadataFilter.
+const (
+	RedactHash = "hash"
+	RedactMask = "mask"
+)
+
+// MetadataFilter limits which labels and environment variables are shipped as fields.
+//
+// Patterns are matched against keys with path.Match.
+type MetadataFilter struct {
+	// Allow lists the label keys to ship, all if empty.
+	Allow []string
+	// Deny lists label keys to drop, it takes precedence over Allow.
+	Deny []string
+	// Redact lists label and environment keys whose values are hashed or masked.
+	Redact     []string
+	RedactMode string
+	// MaxLength drops values longer than MaxLength bytes, if > 0.
+	MaxLength int
+	// Env lists the environment variables to ship.
+	Env []string
+}
+
+// Optional groups of metadata fields.
+const (
+	// GroupNetwork adds the IP addresses per network and the published ports.
+	GroupNetwork = "network"
+	// GroupRuntime adds the image digest (see SetImageDigest), restart count and start time.
+	GroupRuntime = "runtime"
+	// GroupHost adds the name and version of the docker engine running the container.
+	GroupHost = "host"
+)
+
+// Groups are all optional groups of metadata fields.
+var Groups = []string{GroupNetwork, GroupRuntime, GroupHost}
+
+// Metadata computes the fields describing a container.
+type Metadata struct {
+	Schema *Schema
+	Filter *MetadataFilter
+	// Groups are the optional groups of fields to add.
+	Groups map[string]bool
+}
+
+// Fields returns the metadata of container as fields.
+func (metadata *Metadata) Fields(container *docker.Container) map[string]string {
+	schema := metadata.Schema
+	fields := make(map[string]string)
+
+	schema.Set(fields, FieldID, container.ID)
+	schema.Set(fields, FieldHostname, container.Config.Hostname)
+	schema.Set(fields, FieldName, container.Name)
+	schema.Set(fields, FieldImage, container.Config.Image)
+	schema.SetLabels(fields, metadata.Filter.Labels(container.Config.Labels))
+	schema.SetEnv(fields, metadata.Filter.Environment(container.Config.Env))
+
+	if project, ok := metadata.Filter.label(container.Config.Labels, composeProjectLabel); ok {
+		schema.Set(fields, FieldComposeProject, project)
+	}
+	if service, ok := metadata.Filter.label(container.Config.Labels, composeServiceLabel); ok {
+		schema.Set(fields, FieldComposeService, service)
+	}
+	if number, ok := metadata.Filter.label(container.Config.Labels, composeNumberLabel); ok {
+		schema.Set(fields, FieldComposeInstance, number)
+	}
+
+	if container.Node != nil {
+		schema.Set(fields, FieldNodeID, container.Node.ID)
+		schema.Set(fields, FieldNodeIP, container.Node.IP)
+		schema.Set(fields, FieldNodeName, container.Node.Name)
+		schema.SetNodeLabels(fields, metadata.Filter.Labels(container.Node.Labels))
+	}
+
+	if metadata.Groups[GroupNetwork] && container.NetworkSettings != nil {
+		metadata.setNetwork(fields, container.NetworkSettings)
+	}
+	if metadata.Groups[GroupRuntime] {
+		schema.Set(fields, FieldRestartCount, strconv.Itoa(container.RestartCount))
+		if !container.State.StartedAt.IsZero() {
+			schema.Set(fields, FieldStartedAt, container.State.StartedAt.UTC().Format(time.RFC3339))
+		}
+	}
+
+	return fields
+}
+
+// SetImageDigest adds the repo digests of the image of a container to fields (separated with ','),
+// if the runtime group is selected and the image has any.
+func (metadata *Metadata) SetImageDigest(fields map[string]string, digests []string) {
+	if !metadata.Groups[GroupRuntime] || len(digests) == 0 {
+		return
+	}
+	metadata.Schema.Set(fields, FieldImageDigest, strings.Join(digests, ","))
+}
+
+// SetEngine adds the name & version of the docker engine to fields, if the host group is selected.
+func (metadata *Metadata) SetEngine(fields map[string]string, info *docker.DockerInfo) {
+	if !metadata.Groups[GroupHost] || info == nil {
+		return
+	}
+	metadata.Schema.Set(fields, FieldEngineName, info.Name)
+	metadata.Schema.Set(fields, FieldEngineVersion, info.ServerVersion)
+}
+
+// setNetwork adds the IP address per network and the published ports, formatted like
+// `docker ps` does (i.e. 0.0.0.0:8080->80/tcp, 443/tcp).
+func (metadata *Metadata) setNetwork(fields map[string]string, settings *docker.NetworkSettings) {
+	ips := make(map[string]string)
+	for name, network := range settings.Networks {
+		if network.IPAddress != "" {
+			ips[name] = network.IPAddress
+		}
+	}
+	if len(ips) == 0 && settings.IPAddress != "" {
+		ips["bridge"] = settings.IPAddress
+	}
+	metadata.Schema.SetNetworks(fields, ips)
+
+	ports := []string{}
+	for port, bindings := range settings.Ports {
+		if len(bindings) == 0 {
+			ports = append(ports, string(port))
+		}
+		for _, binding := range bindings {
+			host := binding.HostPort
+			if binding.HostIP != "" {
+				host = binding.HostIP + ":" + host
+			}
+			ports = append(ports, fmt.Sprintf("%s->%s", host, port))
+		}
+	}
+	if len(ports) > 0 {
+		sort.Strings(ports)
+		metadata.Schema.Set(fields, FieldPorts, strings.Join(ports, ", "))
+	}
+}
+
+// Labels returns the labels which pass the filter.
+func (filter *MetadataFilter) Labels(labels map[string]string) map[string]string {
+	if filter == nil {
+		return labels
+	}
+
+	filtered := make(map[string]string)
+	for k, v := range labels {
+		if len(filter.Allow) > 0 && !matchesAny(filter.Allow, k) {
+			continue
+		}
+		if matchesAny(filter.Deny, k) {
+			continue
+		}
+		if v, ok := filter.value(k, v); ok {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+// label returns the value of the label key unless it is denied, redacted if configured. Allow is
+// ignored, since it only selects which labels are shipped as label fields.
+func (filter *MetadataFilter) label(labels map[string]string, key string) (string, bool) {
+	v, ok := labels[key]
+	if !ok || filter == nil {
+		return v, ok
+	}
+	if matchesAny(filter.Deny, key) {
+		return "", false
+	}
+	return filter.value(key, v)
+}
+
+// Environment returns the selected variables of env, which is formatted as KEY=value.
+func (filter *MetadataFilter) Environment(env []string) map[string]string {
+	filtered := make(map[string]string)
+	if filter == nil || len(filter.Env) == 0 {
+		return filtered
+	}
+
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || !matchesAny(filter.Env, parts[0]) {
+			continue
+		}
+		if v, ok := filter.value(parts[0], parts[1]); ok {
+			filtered[parts[0]] = v
+		}
+	}
+	return filtered
+}
+
+func (filter *MetadataFilter) value(key string, value string) (string, bool) {
+	if filter.MaxLength > 0 && len(value) > filter.MaxLength {
+		log.Debug("Dropping %s: value exceeds %d bytes", key, filter.MaxLength)
+		return "", false
+	}
+	if !matchesAny(filter.Redact, key) {
+		return value, true
+	}
+	if filter.RedactMode == RedactMask {
+		return "REDACTED", true
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(value))), true
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+func TestFieldsFilterComposeLabels(t *testing.T) {
+	container := &docker.Container{
+		ID:   "abc",
+		Name: "/web_1",
+		Config: &docker.Config{Labels: map[string]string{
+			composeProjectLabel: "shop",
+			composeServiceLabel: "web",
+			composeNumberLabel:  "1",
+		}},
+	}
+
+	tests := []struct {
+		name   string
+		filter *MetadataFilter
+		want   map[string]string
+	}{
+		{"unfiltered", nil, map[string]string{"compose/project": "shop", "compose/service": "web", "compose/instance": "1"}},
+		{"denied", &MetadataFilter{Deny: []string{"com.docker.compose.*"}}, map[string]string{}},
+		{"not allowed", &MetadataFilter{Allow: []string{"com.example.*"}},
+			map[string]string{"compose/project": "shop", "compose/service": "web", "compose/instance": "1"}},
+		{"masked", &MetadataFilter{Redact: []string{composeProjectLabel}, RedactMode: RedactMask},
+			map[string]string{"compose/project": "REDACTED", "compose/service": "web", "compose/instance": "1"}},
+	}
+	for _, test := range tests {
+		metadata := &Metadata{Schema: &LegacySchema, Filter: test.filter}
+		fields := metadata.Fields(container)
+		for _, key := range []string{"compose/project", "compose/service", "compose/instance"} {
+			if fields[key] != test.want[key] {
+				t.Errorf("%s: %s = %q, want %q", test.name, key, fields[key], test.want[key])
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// Probe connects to every server, doing a TLS handshake with the configured ssl files if any are set.
+func (network *Network) Probe(timeout time.Duration) error {
+	dialer := &net.Dialer{Timeout: timeout}
+	for _, server := range network.Servers {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return fmt.Errorf("Invalid server %s: %s", server, err)
+		}
+		tlsConfig, err := network.tlsConfig(host)
+		if err != nil {
+			return err
+		}
+		if tlsConfig == nil {
+			conn, err := dialer.Dial("tcp", server)
+			if err != nil {
+				return err
+			}
+			conn.Close()
+			continue
+		}
+
+		conn, err := tls.DialWithDialer(dialer, "tcp", server, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("TLS handshake with %s failed: %s", server, err)
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS config for host described by the ssl files, nil if none are set.
+func (network *Network) tlsConfig(host string) (*tls.Config, error) {
+	if len(network.SslFiles()) == 0 {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: host}
+	if network.SslCertificate != "" && network.SslKey != "" {
+		cert, err := tls.LoadX509KeyPair(network.SslCertificate, network.SslKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if network.SslCa != "" {
+		pem, err := ioutil.ReadFile(network.SslCa)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", network.SslCa)
+		}
+	}
+	return tlsConfig, nil
+}
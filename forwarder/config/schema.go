@@ -0,0 +1,170 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// Canonical metadata keys a Schema maps to field names.
+const (
+	FieldID              = "id"
+	FieldHostname        = "hostname"
+	FieldName            = "name"
+	FieldImage           = "image"
+	FieldNodeID          = "node/id"
+	FieldNodeIP          = "node/ip"
+	FieldNodeName        = "node/name"
+	FieldComposeProject  = "compose/project"
+	FieldComposeService  = "compose/service"
+	FieldComposeInstance = "compose/instance"
+	FieldDaemon          = "daemon"
+	FieldStream          = "stream"
+	FieldPorts           = "ports"
+	FieldImageDigest     = "image/digest"
+	FieldRestartCount    = "restart count"
+	FieldStartedAt       = "started at"
+	FieldEngineName      = "engine/name"
+	FieldEngineVersion   = "engine/version"
+	FieldHost            = "host"
+)
+
+// Schema defines the field names container metadata is shipped under.
+//
+// Metadata without a mapping in Fields is not shipped, the same goes for labels
+// and environment variables if the corresponding prefix is empty.
+type Schema struct {
+	Fields          map[string]string `json:"fields"`
+	LabelPrefix     string            `json:"label prefix"`
+	NodeLabelPrefix string            `json:"node label prefix"`
+	EnvPrefix       string            `json:"env prefix"`
+	// NetworkPrefix precedes the network names the IP addresses of a container are shipped under.
+	NetworkPrefix string `json:"network prefix"`
+	// LabelSeparator replaces dots within label keys, if set.
+	LabelSeparator string `json:"label separator"`
+}
+
+// LegacySchema is the docker/* layout this project always used.
+var LegacySchema = Schema{
+	Fields: map[string]string{
+		FieldID:              "docker/id",
+		FieldHostname:        "docker/hostname",
+		FieldName:            "docker/name",
+		FieldImage:           "docker/image",
+		FieldNodeID:          "docker/node/id",
+		FieldNodeIP:          "docker/node/ip",
+		FieldNodeName:        "docker/node/name",
+		FieldComposeProject:  "compose/project",
+		FieldComposeService:  "compose/service",
+		FieldComposeInstance: "compose/instance",
+		FieldDaemon:          "docker/daemon",
+		FieldStream:          "docker/stream",
+		FieldPorts:           "docker/ports",
+		FieldImageDigest:     "docker/image/digest",
+		FieldRestartCount:    "docker/restart-count",
+		FieldStartedAt:       "docker/started-at",
+		FieldEngineName:      "docker/engine/name",
+		FieldEngineVersion:   "docker/engine/version",
+		FieldHost:            "host",
+	},
+	LabelPrefix:     "docker/label/",
+	NodeLabelPrefix: "docker/node/label/",
+	EnvPrefix:       "docker/env/",
+	NetworkPrefix:   "docker/ip/",
+	LabelSeparator:  "-",
+}
+
+// ECSSchema follows the Elastic Common Schema (https://www.elastic.co/guide/en/ecs/current/).
+var ECSSchema = Schema{
+	Fields: map[string]string{
+		FieldID:              "container.id",
+		FieldName:            "container.name",
+		FieldImage:           "container.image.name",
+		FieldNodeID:          "host.id",
+		FieldNodeIP:          "host.ip",
+		FieldNodeName:        "host.name",
+		FieldComposeProject:  "compose.project",
+		FieldComposeService:  "compose.service",
+		FieldComposeInstance: "compose.instance",
+		FieldDaemon:          "host.hostname",
+		FieldStream:          "stream",
+		FieldPorts:           "container.ports",
+		FieldImageDigest:     "container.image.hash.all",
+		FieldRestartCount:    "container.restart_count",
+		FieldStartedAt:       "container.started_at",
+		FieldEngineName:      "container.runtime.host",
+		FieldEngineVersion:   "container.runtime.version",
+		FieldHost:            "host.name",
+	},
+	LabelPrefix:    "container.labels.",
+	EnvPrefix:      "container.env.",
+	NetworkPrefix:  "container.ip.",
+	LabelSeparator: "_",
+}
+
+// NewSchema returns the schema identified by name, which is either legacy, ecs
+// or the path of a JSON file containing a Schema.
+func NewSchema(name string) (*Schema, error) {
+	switch name {
+	case "", "legacy":
+		return &LegacySchema, nil
+	case "ecs":
+		return &ECSSchema, nil
+	}
+
+	schemaFile, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer schemaFile.Close()
+
+	schema := new(Schema)
+	if err = json.NewDecoder(schemaFile).Decode(schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// Set stores value in fields under the name mapped to key.
+func (schema *Schema) Set(fields map[string]string, key string, value string) {
+	if name := schema.Fields[key]; name != "" {
+		fields[name] = value
+	}
+}
+
+// SetLabels stores container labels in fields.
+func (schema *Schema) SetLabels(fields map[string]string, labels map[string]string) {
+	schema.setLabels(fields, schema.LabelPrefix, labels)
+}
+
+// SetNodeLabels stores swarm node labels in fields.
+func (schema *Schema) SetNodeLabels(fields map[string]string, labels map[string]string) {
+	schema.setLabels(fields, schema.NodeLabelPrefix, labels)
+}
+
+// SetEnv stores environment variables in fields.
+func (schema *Schema) SetEnv(fields map[string]string, env map[string]string) {
+	if schema.EnvPrefix == "" {
+		return
+	}
+	for k, v := range env {
+		fields[schema.EnvPrefix+k] = v
+	}
+}
+
+// SetNetworks stores the IP address of a container per network in fields.
+func (schema *Schema) SetNetworks(fields map[string]string, ips map[string]string) {
+	schema.setLabels(fields, schema.NetworkPrefix, ips)
+}
+
+func (schema *Schema) setLabels(fields map[string]string, prefix string, labels map[string]string) {
+	if prefix == "" {
+		return
+	}
+	for k, v := range labels {
+		if schema.LabelSeparator != "" {
+			k = strings.Replace(k, ".", schema.LabelSeparator, -1)
+		}
+		fields[prefix+k] = v
+	}
+}
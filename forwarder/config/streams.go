@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Streams are the streams of a containers docker log file.
+var Streams = []string{"stdout", "stderr"}
+
+// Labels controlling how the streams of a containers docker log file get shipped when they are split,
+// %s being the stream.
+const (
+	StreamTypeLabel        = "logstash-forwarder.%s.type"
+	StreamDestinationLabel = "logstash-forwarder.%s.destination"
+	SkipStreamLabel        = "logstash-forwarder.skip-%s"
+)
+
+// StreamSpoolPath returns the path below spoolDir stream of the containers docker log file gets written to.
+func StreamSpoolPath(container *docker.Container, spoolDir string, stream string) string {
+	return filepath.Join(spoolDir, container.ID, stream+".log")
+}
+
+// SkipStream reports whether the container is labeled to not ship stream.
+func SkipStream(container *docker.Container, stream string) bool {
+	return strings.EqualFold(container.Config.Labels[fmt.Sprintf(SkipStreamLabel, stream)], "true")
+}
+
+// NewContainerStreamFiles returns one file section per stream of the containers docker log file,
+// reading the per stream spool files below spoolDir.
+//
+// Each section gets the stream as field, type defaults to the type of the docker log file but
+// can be overridden per stream via the logstash-forwarder.<stream>.type label. Streams labeled with
+// logstash-forwarder.skip-<stream>=true are left out.
+func NewContainerStreamFiles(container *docker.Container, spoolDir string, metadata *Metadata) map[string]File {
+	labels := container.Config.Labels
+	files := make(map[string]File)
+	if strings.EqualFold(labels[SkipDockerLogLabel], "true") {
+		log.Debug("Skipping docker log file of %s", container.ID)
+		return files
+	}
+
+	for _, stream := range Streams {
+		if SkipStream(container, stream) {
+			log.Debug("Skipping %s of %s", stream, container.ID)
+			continue
+		}
+		path := StreamSpoolPath(container, spoolDir, stream)
+		file := File{}
+		file.Paths = []string{path, path + ".1"}
+		file.Fields = metadata.Fields(container)
+		file.Fields["type"] = labelOrDefault(labels, fmt.Sprintf(StreamTypeLabel, stream), labelOrDefault(labels, TypeLabel, "docker"))
+		file.Fields["codec"] = labelOrDefault(labels, CodecLabel, "json")
+		metadata.Schema.Set(file.Fields, FieldStream, stream)
+		files[stream] = file
+	}
+	return files
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DestinationLabel selects the destination a containers files are shipped to.
+const DestinationLabel = "logstash-forwarder.destination"
+
+// DefaultDestination is the name of the destination configured via -logstash / -config.
+const DefaultDestination = "default"
+
+// WrapperConfig configures docker-logstash-forwarder itself (as opposed to logstash-forwarder).
+type WrapperConfig struct {
+	// Destinations are additional, named network sections containers can be routed to.
+	Destinations map[string]Network `json:"destinations"`
+	// Fields are added to every file section which does not set them itself.
+	Fields map[string]string `json:"fields"`
+	// Files are files of the host shipped in addition to those of the containers.
+	Files []HostFile `json:"files"`
+}
+
+// HostFile is a file (or glob) of the host to ship.
+type HostFile struct {
+	Paths    []string          `json:"paths"`
+	Type     string            `json:"type"`
+	Fields   map[string]string `json:"fields"`
+	DeadTime string            `json:"dead time"`
+	// Destination is the name of the destination the file is shipped to, the default one if empty.
+	Destination string `json:"destination"`
+}
+
+// File returns the file section of the host file.
+func (hostFile HostFile) File() File {
+	file := File{Paths: hostFile.Paths, Fields: make(map[string]string), DeadTime: hostFile.DeadTime}
+	for k, v := range hostFile.Fields {
+		file.Fields[k] = v
+	}
+	if hostFile.Type != "" {
+		file.Fields["type"] = hostFile.Type
+	}
+	return file
+}
+
+// NewWrapperFromFile returns a new wrapper config based on the file at path.
+func NewWrapperFromFile(path string) (*WrapperConfig, error) {
+	configFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+
+	wrapperConfig := new(WrapperConfig)
+	if err = json.NewDecoder(configFile).Decode(wrapperConfig); err != nil {
+		return nil, err
+	}
+
+	for i, hostFile := range wrapperConfig.Files {
+		if len(hostFile.Paths) == 0 {
+			return nil, fmt.Errorf("File %d has no paths", i)
+		}
+	}
+	if _, ok := wrapperConfig.Destinations[DefaultDestination]; ok {
+		log.Warning("Ignoring destination %s: the default destination is configured via -logstash or -config", DefaultDestination)
+		delete(wrapperConfig.Destinations, DefaultDestination)
+	}
+	return wrapperConfig, nil
+}
+
+// Destination returns the name of the destination the containers files should be shipped to.
+func (wrapper *WrapperConfig) Destination(container *docker.Container) string {
+	return wrapper.destination("Container "+container.ID, container.Config.Labels[DestinationLabel])
+}
+
+// StreamDestination returns the name of the destination stream of the containers docker log file
+// should be shipped to, which defaults to the destination of the container.
+func (wrapper *WrapperConfig) StreamDestination(container *docker.Container, stream string) string {
+	if name := container.Config.Labels[fmt.Sprintf(StreamDestinationLabel, stream)]; name != "" {
+		return wrapper.destination("Container "+container.ID, name)
+	}
+	return wrapper.Destination(container)
+}
+
+// HostFileDestination returns the name of the destination the host file should be shipped to.
+func (wrapper *WrapperConfig) HostFileDestination(hostFile HostFile) string {
+	return wrapper.destination("Host file "+strings.Join(hostFile.Paths, ","), hostFile.Destination)
+}
+
+// AddFields adds the fields of the wrapper config to file, keeping those file already sets.
+func (wrapper *WrapperConfig) AddFields(file *File) {
+	if len(wrapper.Fields) == 0 {
+		return
+	}
+	if file.Fields == nil {
+		file.Fields = make(map[string]string)
+	}
+	for k, v := range wrapper.Fields {
+		if _, ok := file.Fields[k]; !ok {
+			file.Fields[k] = v
+		}
+	}
+}
+
+func (wrapper *WrapperConfig) destination(requester string, name string) string {
+	if name == "" || name == DefaultDestination {
+		return DefaultDestination
+	}
+	if _, ok := wrapper.Destinations[name]; !ok {
+		log.Warning("%s requests unknown destination %s, using %s", requester, name, DefaultDestination)
+		return DefaultDestination
+	}
+	return name
+}
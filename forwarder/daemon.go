@@ -0,0 +1,79 @@
+package forwarder
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+	"github.com/digital-wonderland/docker-logstash-forwarder/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DockerClient is the part of the docker API needed to discover & watch containers,
+// implemented by *docker.Client.
+type DockerClient interface {
+	utils.EventSource
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	InspectContainer(id string) (*docker.Container, error)
+	InspectImage(name string) (*docker.Image, error)
+	Endpoint() string
+}
+
+// Daemon is a docker daemon whose containers get shipped.
+type Daemon struct {
+	// Name is added as field to every file section, unless empty.
+	Name     string
+	Client   DockerClient
+	DataRoot config.DataRoot
+	// Info is what the daemon reported about itself, only needed for the host group of fields.
+	Info *docker.DockerInfo
+
+	mu sync.Mutex
+	// digests caches the repo digests per image id, only needed for the runtime group of fields.
+	digests map[string][]string
+}
+
+// setFields adds the name of the daemon, if set, the engine fields and the digests of the image
+// of container to file.
+func (daemon *Daemon) setFields(file config.File, container *docker.Container, metadata *config.Metadata) {
+	if daemon.Name != "" {
+		metadata.Schema.Set(file.Fields, config.FieldDaemon, daemon.Name)
+	}
+	metadata.SetEngine(file.Fields, daemon.Info)
+	if metadata.Groups[config.GroupRuntime] {
+		metadata.SetImageDigest(file.Fields, daemon.imageDigests(container.Image))
+	}
+}
+
+// imageDigests returns the repo digests (i.e. sha256:...) of the image with id, which are only known
+// for images pulled from or pushed to a registry.
+func (daemon *Daemon) imageDigests(id string) []string {
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+
+	if digests, ok := daemon.digests[id]; ok {
+		return digests
+	}
+	image, err := daemon.Client.InspectImage(id)
+	if err != nil {
+		log.Warning("Unable to inspect image %s: %s", id, err)
+		return nil
+	}
+
+	digests := []string{}
+	seen := make(map[string]bool)
+	for _, repoDigest := range image.RepoDigests {
+		digest := repoDigest[strings.LastIndex(repoDigest, "@")+1:]
+		if !seen[digest] {
+			seen[digest] = true
+			digests = append(digests, digest)
+		}
+	}
+	sort.Strings(digests)
+	if daemon.digests == nil {
+		daemon.digests = make(map[string][]string)
+	}
+	daemon.digests[id] = digests
+	return digests
+}
@@ -0,0 +1,207 @@
+package forwarder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Rendered is a config TriggerRefresh would write.
+type Rendered struct {
+	Destination string
+	// Path is where the config would be written to.
+	Path    string
+	Content []byte
+}
+
+// Render returns the configs (and fragments) TriggerRefresh would write, without writing them
+// or starting any backend instance.
+func Render(daemons []*Daemon, options Options) ([]Rendered, error) {
+	backend, tmpl := options.backend()
+	destinations, _, err := collect(daemons, options)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := []Rendered{}
+	for _, name := range sortedNames(destinations) {
+		destination := destinations[name]
+		if destination.isEmpty() {
+			continue
+		}
+
+		if options.FragmentsDir != "" {
+			destination.FragmentsDir = filepath.Join(options.FragmentsDir, name)
+			for _, c := range destination.Containers {
+				content, err := renderFragment(backend.Fragment, destination, c)
+				if err != nil {
+					return nil, fmt.Errorf("Unable to render fragment for %s: %s", c.ID, err)
+				}
+				rendered = append(rendered, Rendered{name, filepath.Join(destination.FragmentsDir, c.ID+backend.FragmentExtension), content})
+			}
+		}
+
+		content, err := render(tmpl, destination)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to render %s config for %s: %s", tmpl.Name(), name, err)
+		}
+		rendered = append(rendered, Rendered{name, options.configPath(backend, name), content})
+	}
+	return rendered, nil
+}
+
+// Validate checks the -config file, the network sections of all destinations, the host files as well
+// as the in container configs & log files of all running containers, returning every problem found.
+func Validate(daemons []*Daemon, options Options) []error {
+	problems := []error{}
+
+	networks := map[string]config.Network{}
+	if options.ConfigFile != "" {
+		forwarderConfig, err := config.NewFromFile(options.ConfigFile)
+		if err != nil {
+			return append(problems, fmt.Errorf("%s: %s", options.ConfigFile, err))
+		}
+		networks[config.DefaultDestination] = forwarderConfig.Network
+	} else {
+		networks[config.DefaultDestination] = config.NewFromDefault(options.LogstashEndpoint).Network
+	}
+	for name, network := range options.Wrapper.Destinations {
+		networks[name] = network
+	}
+	for name, network := range networks {
+		if err := network.Validate(); err != nil {
+			problems = append(problems, fmt.Errorf("destination %s: %s", name, err))
+		}
+	}
+
+	for _, hostFile := range options.Wrapper.Files {
+		problems = append(problems, checkReadable(hostFile.Paths)...)
+	}
+
+	for _, daemon := range daemons {
+		containers, err := daemon.Client.ListContainers(docker.ListContainersOptions{All: false})
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Unable to retrieve container list from docker at %s: %s", daemon.Client.Endpoint(), err))
+			continue
+		}
+		for _, c := range containers {
+			container, err := daemon.Client.InspectContainer(c.ID)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("Unable to inspect container %s: %s", c.ID, err))
+				continue
+			}
+			if options.ExcludeComposeOneOff && config.IsComposeOneOff(container) {
+				continue
+			}
+			for _, err := range validateContainer(daemon, container, options) {
+				problems = append(problems, fmt.Errorf("container %s (%s): %s", container.ID[:12], container.Name, err))
+			}
+		}
+	}
+	return problems
+}
+
+func validateContainer(daemon *Daemon, container *docker.Container, options Options) []error {
+	problems := []error{}
+	if file, ok := config.NewContainerLogFile(container, daemon.DataRoot, options.Metadata); ok {
+		problems = append(problems, checkReadable(file.Paths)...)
+	}
+
+	if _, err := config.ResolvePath(container, daemon.DataRoot, "/"); err != nil {
+		return append(problems, err)
+	}
+	containerConfig, err := config.NewFromContainer(container, daemon.DataRoot)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			problems = append(problems, err)
+		}
+		return problems
+	}
+	if containerConfig.Network.IsSet() && options.AllowContainerNetwork {
+		if err := containerConfig.Network.Validate(); err != nil {
+			problems = append(problems, fmt.Errorf("network: %s", err))
+		}
+	}
+	for _, file := range containerConfig.Files {
+		problems = append(problems, checkReadable(file.Paths)...)
+	}
+	return problems
+}
+
+// checkReadable checks that all files matching paths can be opened.
+// Patterns without matches are fine, since the files may just not exist yet.
+func checkReadable(paths []string) []error {
+	problems := []error{}
+	for _, path := range paths {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %s", path, err))
+			continue
+		}
+		for _, match := range matches {
+			f, err := os.Open(match)
+			if err != nil {
+				problems = append(problems, err)
+				continue
+			}
+			f.Close()
+		}
+	}
+	return problems
+}
+
+// Inspection is what Inspect found out about a container.
+type Inspection struct {
+	Destination string
+	ID          string
+	Name        string
+	Daemon      string       `json:",omitempty"`
+	LogFile     *config.File `json:",omitempty"`
+	Files       []config.File
+}
+
+// Inspect returns the files & fields the container with the given name or id is shipped with,
+// one entry per destination its files are shipped to.
+func Inspect(daemons []*Daemon, options Options, name string) ([]Inspection, error) {
+	for _, daemon := range daemons {
+		container, err := daemon.Client.InspectContainer(name)
+		if err != nil {
+			if _, ok := err.(*docker.NoSuchContainer); ok {
+				continue
+			}
+			return nil, err
+		}
+
+		destinations := map[string]*Destination{}
+		for name := range options.Wrapper.Destinations {
+			destinations[name] = newDestination(name, &config.LogstashForwarderConfig{Files: []config.File{}})
+		}
+		destinations[config.DefaultDestination] = newDestination(config.DefaultDestination, &config.LogstashForwarderConfig{Files: []config.File{}})
+		addContainer(daemon, container, destinations, options)
+		for _, destination := range destinations {
+			addFields(destination, options.Wrapper)
+		}
+
+		inspections := []Inspection{}
+		for _, name := range sortedNames(destinations) {
+			for _, c := range destinations[name].Containers {
+				inspections = append(inspections, Inspection{name, c.ID, c.Name, c.Daemon, c.LogFile, c.Files})
+			}
+		}
+		return inspections, nil
+	}
+	return nil, fmt.Errorf("No such container: %s", name)
+}
+
+func sortedNames(destinations map[string]*Destination) []string {
+	names := []string{}
+	for name := range destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
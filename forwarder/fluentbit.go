@@ -0,0 +1,82 @@
+package forwarder
+
+import "text/template"
+
+// fluentBitInputs renders one tail input per file section, with the fields of each section
+// added via record_modifier. Fields without a value are skipped, since record_modifier
+// requires one. All inputs keep their offsets in the same database in the state directory,
+// so restarts continue where the last instance stopped.
+const fluentBitInputs = `{{ range $c := .Containers }}{{ with $c.LogFile }}
+[INPUT]
+    Name             tail
+    Tag              docker.{{ $c.ID }}
+    Path             {{ join .Paths "," }}
+    multiline.parser docker
+    Skip_Long_Lines  On
+    DB               {{ $.StateDir }}/tail.db
+
+[FILTER]
+    Name  record_modifier
+    Match docker.{{ $c.ID }}
+{{ range $k, $v := .Fields }}{{ if $v }}    Record {{ $k }} {{ oneline $v }}
+{{ end }}{{ end }}{{ end }}{{ range $i, $f := $c.Files }}
+[INPUT]
+    Name            tail
+    Tag             file.{{ $c.ID }}.{{ $i }}
+    Path            {{ join $f.Paths "," }}
+    Skip_Long_Lines On
+    DB              {{ $.StateDir }}/tail.db
+
+[FILTER]
+    Name  record_modifier
+    Match file.{{ $c.ID }}.{{ $i }}
+{{ range $k, $v := $f.Fields }}{{ if $v }}    Record {{ $k }} {{ oneline $v }}
+{{ end }}{{ end }}{{ end }}{{ end }}`
+
+// fluentBitHostInputs renders one tail input per host file of the wrapper config.
+const fluentBitHostInputs = `{{ range $i, $f := .HostFiles }}
+[INPUT]
+    Name            tail
+    Tag             host.{{ $i }}
+    Path            {{ join $f.Paths "," }}
+    Skip_Long_Lines On
+    DB              {{ $.StateDir }}/tail.db
+
+[FILTER]
+    Name  record_modifier
+    Match host.{{ $i }}
+{{ range $k, $v := $f.Fields }}{{ if $v }}    Record {{ $k }} {{ oneline $v }}
+{{ end }}{{ end }}{{ end }}`
+
+// fluentBitTemplate renders a Fluent Bit config with all inputs (or an @INCLUDE of the fragments directory
+// and the host file inputs) and all records sent to the first server - Fluent Bit outputs only support
+// a single host, the other servers are ignored (which is noted in the config).
+//
+// TLS is enabled if any ssl file is configured.
+//
+// The output plugin defaults to forward and can be changed to tcp via -backend-option output=tcp.
+var fluentBitTemplate = template.Must(NewTemplate("fluent-bit", `[SERVICE]
+    Flush     1
+    Log_Level {{ if index .Settings "log_level" }}{{ index .Settings "log_level" }}{{ else }}info{{ end }}
+{{ if .FragmentsDir }}    Hot_Reload On
+
+@INCLUDE {{ .FragmentsDir }}/*.conf
+{{ else }}`+fluentBitInputs+`{{ end }}`+fluentBitHostInputs+`
+{{ if gt (len .Network.Servers) 1 }}
+# only the first of the servers {{ join .Network.Servers ", " }} is used
+{{ end }}
+[OUTPUT]
+    Name  {{ if index .Settings "output" }}{{ index .Settings "output" }}{{ else }}forward{{ end }}
+    Match *
+    Host  {{ host (index .Network.Servers 0) }}
+    Port  {{ port (index .Network.Servers 0) }}
+{{ if eq (index .Settings "output") "tcp" }}    Format json_lines
+{{ end }}{{ if .Network.SslFiles }}    tls          On
+    tls.verify   On
+{{ end }}{{ with .Network.SslCertificate }}    tls.crt_file {{ . }}
+{{ end }}{{ with .Network.SslKey }}    tls.key_file {{ . }}
+{{ end }}{{ with .Network.SslCa }}    tls.ca_file  {{ . }}
+{{ end }}`))
+
+// fluentBitFragmentTemplate renders the inputs of a single container.
+var fluentBitFragmentTemplate = template.Must(NewTemplate("fluent-bit-fragment", fluentBitInputs))
@@ -0,0 +1,35 @@
+package forwarder
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+)
+
+func TestFluentBitTemplate(t *testing.T) {
+	file := config.File{Paths: []string{"/a"}, Fields: map[string]string{"type": "docker", "docker/label/empty": ""}}
+	destination := &Destination{
+		Name:       config.DefaultDestination,
+		Network:    config.Network{Servers: []string{"one:24224", "two:24224"}, SslCa: "/ca.crt"},
+		Containers: []*Container{{ID: "abc", LogFile: &file}},
+		Config:     &config.LogstashForwarderConfig{Files: []config.File{file}},
+		StateDir:   "/state/default",
+	}
+
+	rendered, err := render(fluentBitTemplate, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := string(rendered)
+	for _, want := range []string{"Record type docker\n", "tls          On\n", "tls.ca_file  /ca.crt\n", "Host  one\n", "# only the first of the servers one:24224, two:24224 is used\n", "DB               /state/default/tail.db\n"} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("config does not contain %q:\n%s", want, conf)
+		}
+	}
+	for _, unwanted := range []string{"docker/label/empty", "tls.crt_file"} {
+		if strings.Contains(conf, unwanted) {
+			t.Errorf("config contains %q:\n%s", unwanted, conf)
+		}
+	}
+}
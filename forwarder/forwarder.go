@@ -1,10 +1,17 @@
 package forwarder
 
 import (
-	"encoding/json"
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
@@ -13,96 +20,673 @@ import (
 	logging "github.com/op/go-logging"
 )
 
-var (
-	cmd     *exec.Cmd
-	log     = logging.MustGetLogger("forwarder")
-	running = false
-)
+// child is a running backend instance.
+type child struct {
+	backend *Backend
+	process Process
+	// fingerprint covers the config as well as the content of all ssl files it references.
+	fingerprint []byte
+	network     config.Network
+	// path is the config file the instance runs with.
+	path string
+	// exited is closed once the process exited.
+	exited chan struct{}
+}
+
+// alive reports whether the process of c did not exit yet.
+func (c *child) alive() bool {
+	select {
+	case <-c.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+var log = logging.MustGetLogger("forwarder")
+
+// Forwarder runs one backend instance per destination and keeps their configs up to date.
+type Forwarder struct {
+	launcher Launcher
+	// mu serializes refreshes & shutdown.
+	mu           sync.Mutex
+	children     map[string]*child
+	shuttingDown bool
+	lastRefresh  time.Time
+	// expiry fires once the grace period of the next stopped container is over.
+	expiry *time.Timer
+	// onExit is the OnExit hook of the last refresh.
+	onExit func()
+	// spooler splits docker log files by stream, nil unless running with a SpoolDir.
+	spooler *spooler
+	// shipped lists the names of all containers per destination as of the last refresh.
+	shipped map[string][]string
+}
+
+// New returns a Forwarder starting backend instances via launcher, as child processes if nil.
+func New(launcher Launcher) *Forwarder {
+	if launcher == nil {
+		launcher = ExecLauncher{}
+	}
+	return &Forwarder{
+		launcher: launcher,
+		children: make(map[string]*child),
+		shipped:  make(map[string][]string),
+	}
+}
+
+// stopTimeout is how long a backend instance gets to stop after SIGTERM before it is killed.
+const stopTimeout = 10 * time.Second
+
+// Options controls how the logstash-forwarder configuration is generated.
+type Options struct {
+	LogstashEndpoint string
+	ConfigFile       string
+	Quiet            bool
+	// ExcludeComposeOneOff skips containers created by `docker-compose run`.
+	ExcludeComposeOneOff bool
+	Metadata             *config.Metadata
+	Wrapper              *config.WrapperConfig
+	// AllowContainerNetwork runs a separate logstash-forwarder instance for every container
+	// whose config defines its own network section.
+	AllowContainerNetwork bool
+	// Backend is the log shipper to configure & run, DefaultBackend if nil.
+	Backend *Backend
+	// Template renders the config written for every destination instead of the backends template.
+	Template *template.Template
+	// Settings are made available to templates.
+	Settings map[string]string
+	// FragmentsDir enables writing one fragment per container below this directory instead of
+	// restarting the backend, which has to support fragments.
+	FragmentsDir string
+	// SpoolDir enables splitting docker log files by stream: the forwarder writes the lines of
+	// every stream to its own spool file below this directory, which gets shipped instead.
+	SpoolDir string
+	// GracePeriod keeps shipping stopped containers for this long after they exited,
+	// unless the registry of the backend shows their docker log file was read completely.
+	GracePeriod time.Duration
+	// OnExpiry is called once the grace period of a stopped container is over.
+	OnExpiry func()
+	// OnExit is called once a backend instance exited unexpectedly, to get it restarted.
+	OnExit func()
+	// ConfigDir is the directory configs are written to, /tmp if empty.
+	ConfigDir string
+	// StateDir is the directory below which every backend instance runs in a working directory
+	// named after its destination, so instances do not share their registries.
+	StateDir string
+
+	// registry maps paths to the offsets the backend read them to, loaded by collect.
+	registry map[string]int64
+}
 
-func getConfig(logstashEndpoint string, configFile string) *config.LogstashForwarderConfig {
+func getConfig(logstashEndpoint string, configFile string) (*config.LogstashForwarderConfig, error) {
 	if configFile != "" {
 		config, err := config.NewFromFile(configFile)
 		if err != nil {
-			log.Fatalf("Unable to read logstash-forwarder config from %s: %s", configFile, err)
+			return nil, fmt.Errorf("Unable to read logstash-forwarder config from %s: %s", configFile, err)
 		}
 		log.Info("Using logstash-forwarder config from %s as template", configFile)
-		return config
+		return config, nil
 	}
-	return config.NewFromDefault(logstashEndpoint)
+	return config.NewFromDefault(logstashEndpoint), nil
 }
 
-// TriggerRefresh refreshes the logstash-forwarder configuration and restarts it.
-func TriggerRefresh(client *docker.Client, logstashEndpoint string, configFile string, quiet bool) {
+// TriggerRefresh refreshes the configurations and restarts every backend instance
+// whose configuration changed.
+//
+// One instance is run per destination, shipping the containers of all daemons. An error is
+// returned if a config could not be generated or an instance could not be started.
+func (f *Forwarder) TriggerRefresh(daemons []*Daemon, options Options) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.shuttingDown {
+		log.Debug("Shutting down, skipping refresh")
+		return nil
+	}
 	defer utils.TimeTrack(time.Now(), "Config generation")
 
 	log.Debug("Generating configuration...")
-	forwarderConfig := getConfig(logstashEndpoint, configFile)
+	destinations, expiry, err := collect(daemons, options)
+	if err != nil {
+		return fmt.Errorf("Keeping the current configuration: %s", err)
+	}
+	if f.expiry != nil {
+		f.expiry.Stop()
+		f.expiry = nil
+	}
+	if !expiry.IsZero() && options.OnExpiry != nil {
+		f.expiry = time.AfterFunc(time.Until(expiry), options.OnExpiry)
+	}
+	f.onExit = options.OnExit
+	if options.SpoolDir != "" {
+		if f.spooler == nil || f.spooler.dir != options.SpoolDir {
+			if f.spooler != nil {
+				f.spooler.halt()
+			}
+			f.spooler = newSpooler(options.SpoolDir)
+		}
+		var registry func() map[string]int64
+		if backend, _ := options.backend(); backend.Registry != nil {
+			registry = func() map[string]int64 { return backend.registry(options.StateDir) }
+		}
+		f.spooler.sync(spoolJobs(destinations), registry)
+	}
+
+	for name, c := range f.children {
+		if _, ok := destinations[name]; !ok {
+			f.stop(name, c)
+			delete(f.children, name)
+		}
+	}
+
+	backend, tmpl := options.backend()
+	for name, destination := range destinations {
+		if destination.isEmpty() {
+			if c, ok := f.children[name]; ok {
+				f.stop(name, c)
+				delete(f.children, name)
+			}
+			continue
+		}
 
-	containers, err := client.ListContainers(docker.ListContainersOptions{All: false})
+		fragmentsChanged := false
+		if options.FragmentsDir != "" {
+			destination.FragmentsDir = filepath.Join(options.FragmentsDir, name)
+			if fragmentsChanged, err = writeFragments(backend.Fragment, backend.FragmentExtension, destination); err != nil {
+				return fmt.Errorf("Unable to write fragments for %s to %s: %s", name, destination.FragmentsDir, err)
+			}
+		}
+
+		rendered, err := render(tmpl, destination)
+		if err != nil {
+			return fmt.Errorf("Unable to render %s config for %s: %s", tmpl.Name(), name, err)
+		}
+		restarted, err := f.refresh(name, rendered, destination.Network, backend, options)
+		if err != nil {
+			return err
+		}
+		if !restarted && fragmentsChanged {
+			f.reload(name)
+		}
+	}
+
+	if options.FragmentsDir != "" {
+		removeStaleFragmentDirs(options.FragmentsDir, destinations)
+	}
+
+	f.lastRefresh = time.Now()
+	f.shipped = make(map[string][]string)
+	for name, destination := range destinations {
+		for _, c := range destination.Containers {
+			f.shipped[name] = append(f.shipped[name], c.Name)
+		}
+	}
+	return nil
+}
+
+// refreshDaemon adds the containers of daemon to destinations.
+//
+// Stopped containers are only listed with a grace period - the earliest time the grace period
+// of one of them ends is returned, zero if no stopped container got added.
+func refreshDaemon(daemon *Daemon, destinations map[string]*Destination, options Options) (time.Time, error) {
+	var expiry time.Time
+	containers, err := daemon.Client.ListContainers(docker.ListContainersOptions{All: options.GracePeriod > 0})
 	if err != nil {
-		log.Fatalf("Unable to retrieve container list from docker: %s", err)
+		return expiry, fmt.Errorf("Unable to retrieve container list from docker at %s: %s", daemon.Client.Endpoint(), err)
 	}
 
-	log.Debug("Found %d containers:", len(containers))
+	log.Debug("Found %d containers at %s:", len(containers), daemon.Client.Endpoint())
 	for i, c := range containers {
 		log.Debug("%d. %s", i+1, c.ID)
+		if c.State == "created" {
+			continue
+		}
+		if exited, ok := exitedFor(c.Status); ok && exited >= options.GracePeriod {
+			continue
+		}
 
-		container, err := client.InspectContainer(c.ID)
+		container, err := daemon.Client.InspectContainer(c.ID)
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			log.Debug("Skipping container %s, it got removed", c.ID)
+			continue
+		}
 		if err != nil {
-			log.Fatalf("Unable to inspect container %s: %s", c.ID, err)
+			return expiry, fmt.Errorf("Unable to inspect container %s: %s", c.ID, err)
 		}
 
-		forwarderConfig.AddContainerLogFile(container)
-
-		containerConfig, err := config.NewFromContainer(container)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				log.Error("Unable to look for logstash-forwarder config in %s: %s", container.ID, err)
+		if options.ExcludeComposeOneOff && config.IsComposeOneOff(container) {
+			log.Debug("Skipping one-off compose container %s", c.ID)
+			continue
+		}
+		if !container.State.Running {
+			until := container.State.FinishedAt.Add(options.GracePeriod)
+			if !time.Now().Before(until) || container.State.FinishedAt.IsZero() {
+				continue
 			}
-		} else {
-			for _, file := range containerConfig.Files {
-				file.Fields["host"] = container.Config.Hostname
-				forwarderConfig.Files = append(forwarderConfig.Files, file)
+			if drained(container, daemon.DataRoot, options) {
+				log.Debug("Dropping stopped container %s, its docker log file was read completely", c.ID)
+				continue
+			}
+			log.Debug("Keeping stopped container %s until %s", c.ID, until.Format(time.RFC3339))
+			if expiry.IsZero() || until.Before(expiry) {
+				expiry = until
 			}
 		}
+		addContainer(daemon, container, destinations, options)
+	}
+	return expiry, nil
+}
+
+var exitedStatus = regexp.MustCompile(`^Exited \(-?[0-9]+\) (.+) ago$`)
+
+// exitedFor returns a lower bound of how long ago a container exited, given its status as listed
+// by docker (i.e. "Exited (0) 5 minutes ago"), so containers exited long ago need not be inspected.
+func exitedFor(status string) (time.Duration, bool) {
+	match := exitedStatus.FindStringSubmatch(status)
+	if match == nil {
+		return 0, false
+	}
+	switch match[1] {
+	case "Less than a second":
+		return 0, true
+	case "About a minute":
+		return time.Minute, true
+	case "About an hour":
+		return 46 * time.Minute, true
 	}
 
-	const configPath = "/tmp/logstash-forwarder.conf"
-	fo, err := os.Create(configPath)
+	var n int64
+	var unit string
+	if _, err := fmt.Sscanf(match[1], "%d %s", &n, &unit); err != nil {
+		return 0, false
+	}
+	// docker rounds to full hours from 46 minutes on, so all bounds based on hours are lowered by half an hour
+	day := 24 * time.Hour
+	switch strings.TrimSuffix(unit, "s") {
+	case "second":
+		return time.Duration(n) * time.Second, true
+	case "minute":
+		return time.Duration(n) * time.Minute, true
+	case "hour":
+		return time.Duration(n)*time.Hour - 30*time.Minute, true
+	case "day":
+		return time.Duration(n)*day - 30*time.Minute, true
+	case "week":
+		return time.Duration(n)*7*day - 30*time.Minute, true
+	case "month":
+		return time.Duration(n)*30*day - 30*time.Minute, true
+	case "year":
+		return time.Duration(n) * 365 * day, true
+	}
+	return 0, false
+}
+
+// drained reports whether the docker log file of container was read completely according to the registry,
+// or with split streams whether it was spooled completely and its spool files were read completely.
+func drained(container *docker.Container, root config.DataRoot, options Options) bool {
+	registry := options.registry
+	if registry == nil {
+		return false
+	}
+	path := config.ContainerLogPath(container, root)
+	if options.SpoolDir != "" {
+		return spoolDrained(filepath.Join(options.SpoolDir, container.ID), path, registry)
+	}
+	offset, ok := registry[path]
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && offset >= info.Size()
+}
+
+// addContainer adds the docker log file and the files of the in container config of container
+// to their destinations.
+func addContainer(daemon *Daemon, container *docker.Container, destinations map[string]*Destination, options Options) {
+	data := &Container{
+		ID:       container.ID,
+		Name:     container.Name,
+		Hostname: container.Config.Hostname,
+		Image:    container.Config.Image,
+		Labels:   container.Config.Labels,
+		Daemon:   daemon.Name,
+		DataRoot: daemon.DataRoot,
+		Docker:   container,
+	}
+	destination := destinations[options.Wrapper.Destination(container)]
+	// others holds the data of this container for every destination but its own.
+	others := make(map[*Destination]*Container)
+	addFiles := func(target *Destination, files ...config.File) {
+		target.Config.Files = append(target.Config.Files, files...)
+		if target == destination {
+			data.Files = append(data.Files, files...)
+			return
+		}
+		if _, ok := others[target]; !ok {
+			containerData := *data
+			containerData.LogFile = nil
+			containerData.Files = nil
+			others[target] = &containerData
+			target.Containers = append(target.Containers, &containerData)
+		}
+		others[target].Files = append(others[target].Files, files...)
+	}
+
+	if options.SpoolDir != "" {
+		streamFiles := config.NewContainerStreamFiles(container, options.SpoolDir, options.Metadata)
+		for _, stream := range config.Streams {
+			if file, ok := streamFiles[stream]; ok {
+				daemon.setFields(file, container, options.Metadata)
+				addFiles(destinations[options.Wrapper.StreamDestination(container, stream)], file)
+			}
+		}
+	} else if file, ok := config.NewContainerLogFile(container, daemon.DataRoot, options.Metadata); ok {
+		daemon.setFields(file, container, options.Metadata)
+		data.LogFile = &file
+		destination.Config.Files = append(destination.Config.Files, file)
+	}
+
+	containerConfig, err := config.NewFromContainer(container, daemon.DataRoot)
 	if err != nil {
-		log.Fatalf("Unable to open %s: %s", configPath, err)
+		if !os.IsNotExist(err) {
+			log.Error("Unable to look for logstash-forwarder config in %s: %s", container.ID, err)
+		}
+	} else {
+		target := destination
+		if containerConfig.Network.IsSet() {
+			if name, ok := containerNetwork(container, containerConfig, options.AllowContainerNetwork); ok {
+				target = newDestination(name, &config.LogstashForwarderConfig{Network: containerConfig.Network, Files: []config.File{}})
+				destinations[name] = target
+			}
+		}
+		files := []config.File{}
+		for _, file := range containerConfig.Files {
+			files = append(files, containerFile(daemon, container, file, options.Metadata))
+		}
+		addFiles(target, files...)
+	}
+	destination.Containers = append(destination.Containers, data)
+}
+
+// containerFile returns file of the in container config of container with the same metadata
+// its docker log file gets added. Fields set by file itself take precedence over the metadata,
+// which takes precedence over the host field defaulting to the hostname of the container.
+func containerFile(daemon *Daemon, container *docker.Container, file config.File, metadata *config.Metadata) config.File {
+	own := file.Fields
+	file.Fields = make(map[string]string)
+	metadata.Schema.Set(file.Fields, config.FieldHost, container.Config.Hostname)
+	for k, v := range metadata.Fields(container) {
+		file.Fields[k] = v
 	}
-	defer fo.Close()
+	daemon.setFields(file, container, metadata)
+	for k, v := range own {
+		file.Fields[k] = v
+	}
+	return file
+}
 
-	j, err := json.MarshalIndent(forwarderConfig, "", "  ")
+// Networks returns the network sections of all destinations known without inspecting containers,
+// that is the default one and those of the wrapper config.
+func Networks(options Options) (map[string]config.Network, error) {
+	forwarderConfig, err := getConfig(options.LogstashEndpoint, options.ConfigFile)
 	if err != nil {
-		log.Debug("Unable to MarshalIndent logstash-forwarder config: %s", err)
+		return nil, err
+	}
+	networks := map[string]config.Network{config.DefaultDestination: forwarderConfig.Network}
+	for name, network := range options.Wrapper.Destinations {
+		networks[name] = network
 	}
-	_, err = fo.Write(j)
+	return networks, nil
+}
+
+// collect returns all destinations with the containers of all daemons added, as well as the
+// earliest time the grace period of a stopped container ends.
+//
+// Daemons which can not be listed are skipped, so the others keep being shipped - unless all of them fail.
+func collect(daemons []*Daemon, options Options) (map[string]*Destination, time.Time, error) {
+	forwarderConfig, err := getConfig(options.LogstashEndpoint, options.ConfigFile)
 	if err != nil {
-		log.Fatalf("Unable to write logstash-forwarder config to %s: %s", configPath, err)
+		return nil, time.Time{}, err
+	}
+	destinations := map[string]*Destination{
+		config.DefaultDestination: newDestination(config.DefaultDestination, forwarderConfig),
+	}
+	for name, network := range options.Wrapper.Destinations {
+		destinations[name] = newDestination(name, &config.LogstashForwarderConfig{Network: network, Files: []config.File{}})
+	}
+
+	if backend, _ := options.backend(); options.GracePeriod > 0 && backend.Registry != nil {
+		options.registry = backend.registry(options.StateDir)
+	}
+
+	var expiry time.Time
+	failed := 0
+	for _, daemon := range daemons {
+		e, err := refreshDaemon(daemon, destinations, options)
+		if err != nil {
+			log.Error("Skipping daemon: %s", err)
+			if failed++; failed == len(daemons) {
+				return nil, expiry, err
+			}
+			continue
+		}
+		if !e.IsZero() && (expiry.IsZero() || e.Before(expiry)) {
+			expiry = e
+		}
 	}
-	log.Info("Wrote logstash-forwarder config to %s", configPath)
+	for _, hostFile := range options.Wrapper.Files {
+		destination := destinations[options.Wrapper.HostFileDestination(hostFile)]
+		file := hostFile.File()
+		destination.HostFiles = append(destination.HostFiles, file)
+		destination.Config.Files = append(destination.Config.Files, file)
+	}
+	for name, destination := range destinations {
+		destination.Settings = options.Settings
+		destination.StateDir = filepath.Join(options.StateDir, name)
+		addFields(destination, options.Wrapper)
+	}
+	return destinations, expiry, nil
+}
+
+// addFields adds the fields of the wrapper config to all file sections of destination.
+//
+// File sections share their fields with the Containers of destination, so those get them as well.
+func addFields(destination *Destination, wrapper *config.WrapperConfig) {
+	for i := range destination.Config.Files {
+		wrapper.AddFields(&destination.Config.Files[i])
+	}
+}
+
+// backend returns the backend to run & the template to render its config with.
+func (options Options) backend() (*Backend, *template.Template) {
+	backend := options.Backend
+	if backend == nil {
+		backend = DefaultBackend
+	}
+	tmpl := options.Template
+	if tmpl == nil {
+		tmpl = backend.Template
+	}
+	return backend, tmpl
+}
+
+// configPath returns the path of the config of backend for destination name.
+func (options Options) configPath(backend *Backend, name string) string {
+	dir := options.ConfigDir
+	if dir == "" {
+		dir = "/tmp"
+	}
+	if name == config.DefaultDestination {
+		return filepath.Join(dir, backend.Name+".conf")
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.conf", backend.Name, name))
+}
+
+func newDestination(name string, forwarderConfig *config.LogstashForwarderConfig) *Destination {
+	return &Destination{
+		Name:       name,
+		Network:    forwarderConfig.Network,
+		Containers: []*Container{},
+		Config:     forwarderConfig,
+	}
+}
+
+// containerNetwork returns the destination name for the network section of a containers config,
+// if the policy allows it to be used.
+func containerNetwork(container *docker.Container, containerConfig *config.LogstashForwarderConfig, allowed bool) (string, bool) {
+	if !allowed {
+		log.Warning("Ignoring network section of logstash-forwarder config in %s: -allow-container-network is not set", container.ID)
+		return "", false
+	}
+	if err := containerConfig.Network.Validate(); err != nil {
+		log.Warning("Ignoring network section of logstash-forwarder config in %s: %s", container.ID, err)
+		return "", false
+	}
+	return "container-" + container.ID[:12], true
+}
+
+// refresh writes the config of destination name and (re)starts its backend instance,
+// if the config, any ssl file of network (i.e. after certificate rotation) or the backend changed.
+//
+// It reports whether the instance was (re)started.
+func (f *Forwarder) refresh(name string, j []byte, network config.Network, backend *Backend, options Options) (bool, error) {
+	fingerprint := fingerprint(j, network)
+	c, running := f.children[name]
+	running = running && c.alive()
+	if running && c.backend == backend && bytes.Equal(c.fingerprint, fingerprint) {
+		log.Debug("%s config for %s is unchanged", backend.Name, name)
+		return false, nil
+	}
+
+	path := options.configPath(backend, name)
+	if err := ioutil.WriteFile(path, j, 0644); err != nil {
+		return false, fmt.Errorf("Unable to write %s config to %s: %s", backend.Name, path, err)
+	}
+	log.Info("Wrote %s config for %s to %s", backend.Name, name, path)
 
 	if running {
-		log.Info("Waiting for logstash-forwarder to stop")
-		// perhaps use SIGTERM first instead of just Kill()?
-		//		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
-		if err := cmd.Process.Kill(); err != nil {
-			log.Error("Unable to stop logstash-forwarder")
+		f.stop(name, c)
+	}
+	dir := filepath.Join(options.StateDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, fmt.Errorf("Unable to create working directory %s for %s: %s", dir, name, err)
+	}
+	cmd := backend.Command(path, options.Quiet)
+	cmd.Dir = dir
+	process, err := f.launcher.Launch(cmd)
+	if err != nil {
+		return false, fmt.Errorf("Unable to start %s for %s: %s", backend.Name, name, err)
+	}
+	c = &child{backend: backend, process: process, fingerprint: fingerprint, network: network, path: path, exited: make(chan struct{})}
+	f.children[name] = c
+	go f.wait(name, c)
+	log.Info("Starting %s for %s...", backend.Name, name)
+	return true, nil
+}
+
+// wait waits for the backend instance c of destination name to exit. If it was not stopped
+// by the forwarder, it is forgotten so the next refresh starts it again.
+func (f *Forwarder) wait(name string, c *child) {
+	err := c.process.Wait()
+	close(c.exited)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.children[name] == c {
+		log.Error("%s for %s exited unexpectedly: %v", c.backend.Name, name, err)
+		delete(f.children, name)
+		if f.onExit != nil && !f.shuttingDown {
+			f.onExit()
 		}
-		if _, err := cmd.Process.Wait(); err != nil {
-			log.Error("Unable to wait for logstash-forwarder to stop: %s", err)
+	}
+}
+
+// reload tells the backend instance of destination name to pick up changed fragments.
+func (f *Forwarder) reload(name string) {
+	c, ok := f.children[name]
+	if !ok || c.backend.Reload == nil {
+		return
+	}
+	log.Info("Reloading %s for %s", c.backend.Name, name)
+	if err := c.process.Signal(c.backend.Reload); err != nil {
+		log.Error("Unable to reload %s for %s: %s", c.backend.Name, name, err)
+	}
+}
+
+func fingerprint(j []byte, network config.Network) []byte {
+	h := sha256.New()
+	h.Write(j)
+	for _, path := range network.SslFiles() {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(h, "%s: %s", path, err)
 		}
-		log.Info("Stopped logstash-forwarder")
+		h.Write(content)
 	}
-	cmd = exec.Command("logstash-forwarder", "-config", configPath, fmt.Sprintf("-quiet=%t", quiet))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	return h.Sum(nil)
+}
+
+// WatchedFiles returns all ssl files referenced by running backend instances.
+func (f *Forwarder) WatchedFiles() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	files := []string{}
+	for _, c := range f.children {
+		files = append(files, c.network.SslFiles()...)
+	}
+	return files
+}
 
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("Unable to start logstash-forwarder: %s", err)
+// stop gracefully stops a backend instance - it gets killed if it does not stop within stopTimeout.
+func (f *Forwarder) stop(name string, c *child) {
+	log.Info("Waiting for %s for %s to stop", c.backend.Name, name)
+
+	if err := c.process.Signal(syscall.SIGTERM); err != nil {
+		log.Warning("Unable to send SIGTERM to %s for %s: %s", c.backend.Name, name, err)
+	}
+	select {
+	case <-c.exited:
+	case <-time.After(stopTimeout):
+		log.Warning("%s for %s did not stop within %s, killing it", c.backend.Name, name, stopTimeout)
+		if err := c.process.Kill(); err != nil {
+			log.Error("Unable to stop %s for %s: %s", c.backend.Name, name, err)
+		}
+		<-c.exited
+	}
+	log.Info("Stopped %s for %s", c.backend.Name, name)
+}
+
+// Shutdown stops all backend instances, no refreshes happen afterwards.
+func (f *Forwarder) Shutdown() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.shuttingDown = true
+	if f.expiry != nil {
+		f.expiry.Stop()
+	}
+	if f.spooler != nil {
+		f.spooler.halt()
+	}
+	for name, c := range f.children {
+		f.stop(name, c)
+		delete(f.children, name)
+	}
+}
+
+// DumpState logs all running backend instances & the containers they ship.
+func (f *Forwarder) DumpState() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.lastRefresh.IsZero() {
+		log.Info("No refresh happened yet")
+	} else {
+		log.Info("Last refresh at %s", f.lastRefresh.Format(time.RFC3339))
+	}
+	for name, c := range f.children {
+		log.Info("Destination %s: %s (pid %d) configured via %s, shipping %d containers %v",
+			name, c.backend.Name, c.process.Pid(), c.path, len(f.shipped[name]), f.shipped[name])
 	}
-	running = true
-	log.Info("Starting logstash-forwarder...")
 }
@@ -0,0 +1,483 @@
+package forwarder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/fakedocker"
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+	"github.com/digital-wonderland/docker-logstash-forwarder/utils"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// fakeLauncher records every launched command, its processes exit once signaled.
+type fakeLauncher struct {
+	mu        sync.Mutex
+	processes []*fakeProcess
+	err       error
+}
+
+func (l *fakeLauncher) Launch(cmd *exec.Cmd) (Process, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return nil, l.err
+	}
+	process := &fakeProcess{cmd: cmd, pid: len(l.processes) + 1, exited: make(chan struct{})}
+	l.processes = append(l.processes, process)
+	return process, nil
+}
+
+func (l *fakeLauncher) launched() []*fakeProcess {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*fakeProcess{}, l.processes...)
+}
+
+type fakeProcess struct {
+	cmd    *exec.Cmd
+	pid    int
+	once   sync.Once
+	exited chan struct{}
+}
+
+func (p *fakeProcess) Pid() int                   { return p.pid }
+func (p *fakeProcess) Signal(sig os.Signal) error { p.exit(); return nil }
+func (p *fakeProcess) Kill() error                { p.exit(); return nil }
+func (p *fakeProcess) Wait() error                { <-p.exited; return nil }
+func (p *fakeProcess) exit()                      { p.once.Do(func() { close(p.exited) }) }
+
+func (p *fakeProcess) running() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// testEnv is a fake docker daemon whose data root is a temporary directory.
+type testEnv struct {
+	t        *testing.T
+	dir      string
+	server   *fakedocker.Server
+	daemon   *Daemon
+	launcher *fakeLauncher
+	f        *Forwarder
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := fakedocker.NewServer(filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	launcher := &fakeLauncher{}
+	return &testEnv{
+		t:        t,
+		dir:      dir,
+		server:   server,
+		daemon:   &Daemon{Client: client, DataRoot: config.DataRoot{Local: filepath.Join(dir, "docker")}},
+		launcher: launcher,
+		f:        New(launcher),
+	}
+}
+
+func (env *testEnv) close() {
+	env.f.Shutdown()
+	env.server.Close()
+	os.RemoveAll(env.dir)
+}
+
+func (env *testEnv) options(gracePeriod time.Duration) Options {
+	return Options{
+		LogstashEndpoint: "logstash:5043",
+		Metadata:         &config.Metadata{Schema: &config.LegacySchema},
+		Wrapper:          &config.WrapperConfig{},
+		GracePeriod:      gracePeriod,
+		ConfigDir:        env.dir,
+		StateDir:         filepath.Join(env.dir, "state"),
+	}
+}
+
+func (env *testEnv) refresh(gracePeriod time.Duration) {
+	if err := env.f.TriggerRefresh([]*Daemon{env.daemon}, env.options(gracePeriod)); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+// config returns the logstash-forwarder config written for the default destination.
+func (env *testEnv) config() string {
+	content, err := ioutil.ReadFile(filepath.Join(env.dir, "logstash-forwarder.conf"))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	return string(content)
+}
+
+func (env *testEnv) assertLaunches(step string, want int) []*fakeProcess {
+	processes := env.launcher.launched()
+	if len(processes) != want {
+		env.t.Fatalf("%s: %d launches, want %d", step, len(processes), want)
+	}
+	return processes
+}
+
+func newContainer(id string) *docker.Container {
+	return &docker.Container{
+		ID:          id,
+		Name:        "/web",
+		Config:      &docker.Config{Hostname: "web", Labels: map[string]string{}},
+		Driver:      "overlay2",
+		GraphDriver: &docker.GraphDriver{Name: "overlay2", Data: map[string]string{"MergedDir": "/var/lib/docker/overlay2/" + id + "/merged"}},
+	}
+}
+
+func TestTriggerRefreshLifecycle(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+
+	container := newContainer("abc")
+	logPath := filepath.Join(env.dir, "docker/containers/abc/abc-json.log")
+	env.server.Start(container)
+
+	env.refresh(time.Hour)
+	processes := env.assertLaunches("start", 1)
+	if !strings.Contains(env.config(), logPath) {
+		t.Errorf("start: config does not ship %s:\n%s", logPath, env.config())
+	}
+	if dir := processes[0].cmd.Dir; dir != filepath.Join(env.dir, "state", config.DefaultDestination) {
+		t.Errorf("start: working directory is %s", dir)
+	}
+
+	env.refresh(time.Hour)
+	env.assertLaunches("unchanged", 1)
+
+	merged := filepath.Join(env.dir, "docker/overlay2/abc/merged")
+	if err := os.MkdirAll(filepath.Join(merged, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	containerConfig := `{"files": [{"paths": ["/var/log/app.log"], "fields": {"type": "app"}}]}`
+	if err := ioutil.WriteFile(filepath.Join(merged, "etc/logstash-forwarder.conf"), []byte(containerConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env.refresh(time.Hour)
+	processes = env.assertLaunches("config change", 2)
+	if processes[0].running() {
+		t.Error("config change: previous instance is still running")
+	}
+	if appPath := filepath.Join(merged, "var/log/app.log"); !strings.Contains(env.config(), appPath) {
+		t.Errorf("config change: config does not ship %s:\n%s", appPath, env.config())
+	}
+
+	env.server.Die(container.ID)
+	env.refresh(time.Hour)
+	env.assertLaunches("die within grace period", 2)
+	if !strings.Contains(env.config(), logPath) {
+		t.Errorf("die within grace period: config does not ship %s anymore", logPath)
+	}
+
+	env.refresh(time.Nanosecond)
+	processes = env.assertLaunches("grace period over", 3)
+	if strings.Contains(env.config(), logPath) {
+		t.Errorf("grace period over: config still ships %s", logPath)
+	}
+
+	env.f.Shutdown()
+	if processes[2].running() {
+		t.Error("stop: instance is still running")
+	}
+	if err := env.f.TriggerRefresh([]*Daemon{env.daemon}, env.options(time.Hour)); err != nil {
+		t.Errorf("stop: refresh after shutdown failed: %s", err)
+	}
+	env.assertLaunches("stop", 3)
+}
+
+func TestTriggerRefreshRestartsCrashedInstance(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+
+	env.server.Start(newContainer("abc"))
+	exited := make(chan struct{}, 1)
+	options := env.options(0)
+	options.OnExit = func() { exited <- struct{}{} }
+	if err := env.f.TriggerRefresh([]*Daemon{env.daemon}, options); err != nil {
+		t.Fatal(err)
+	}
+	processes := env.assertLaunches("start", 1)
+
+	processes[0].exit()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnExit was not called for the crashed instance")
+	}
+	env.f.mu.Lock()
+	_, ok := env.f.children[config.DefaultDestination]
+	env.f.mu.Unlock()
+	if ok {
+		t.Fatal("crashed instance was not forgotten")
+	}
+
+	env.refresh(0)
+	env.assertLaunches("crash", 2)
+}
+
+// awaitRefresh repeats event until the docker event listener refreshed, since fakedocker drops
+// events until the listener is connected.
+func (env *testEnv) awaitRefresh(step string, refreshed <-chan error, event func()) {
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		event()
+		select {
+		case err := <-refreshed:
+			if err != nil {
+				env.t.Fatalf("%s: %s", step, err)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			env.t.Fatalf("%s: no refresh", step)
+		}
+	}
+}
+
+// awaitShipped waits until the config does (not) ship the docker log file of container id.
+func (env *testEnv) awaitShipped(step string, id string, shipped bool) {
+	logPath := filepath.Join(env.dir, "docker/containers", id, id+"-json.log")
+	for deadline := time.Now().Add(5 * time.Second); strings.Contains(env.config(), logPath) != shipped; {
+		if time.Now().After(deadline) {
+			env.t.Fatalf("%s: config ships %s: %t, want %t", step, logPath, !shipped, shipped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDockerEventsTriggerRefresh(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+
+	refreshed := make(chan error, 16)
+	refresh := func() {
+		utils.Refresh.Mu.Lock()
+		utils.Refresh.IsTriggered = false
+		utils.Refresh.Mu.Unlock()
+		err := env.f.TriggerRefresh([]*Daemon{env.daemon}, env.options(0))
+		select {
+		case refreshed <- err:
+		default:
+		}
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go utils.RegisterDockerEventListener(env.daemon.Client, refresh, &wg, 0, done)
+
+	env.awaitRefresh("start", refreshed, func() { env.server.Start(newContainer("abc")) })
+	env.assertLaunches("start", 1)
+
+	env.awaitRefresh("second start", refreshed, func() { env.server.Start(newContainer("def")) })
+	env.assertLaunches("second start", 2)
+	env.awaitShipped("second start", "def", true)
+
+	// stop emits die & stop, destroy drops the container from the config right away
+	env.server.Stop("def")
+	env.awaitShipped("stop", "def", false)
+	env.server.Destroy("abc")
+	env.awaitShipped("destroy", "abc", false)
+
+	close(done)
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not stop")
+	}
+	utils.Refresh.Stop()
+}
+
+func TestTriggerRefreshErrors(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+
+	env.server.Start(newContainer("abc"))
+	stopped, err := fakedocker.NewServer(filepath.Join(env.dir, "stopped.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped.Close()
+	client, err := docker.NewClient(stopped.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := &Daemon{Client: client}
+
+	if err := env.f.TriggerRefresh([]*Daemon{unreachable, env.daemon}, env.options(0)); err != nil {
+		t.Errorf("one daemon failing: %s", err)
+	}
+	env.assertLaunches("one daemon failing", 1)
+
+	if err := env.f.TriggerRefresh([]*Daemon{unreachable}, env.options(0)); err == nil {
+		t.Error("all daemons failing: no error")
+	}
+	if processes := env.assertLaunches("all daemons failing", 1); !processes[0].running() {
+		t.Error("all daemons failing: instance got stopped")
+	}
+
+	options := env.options(0)
+	options.ConfigFile = filepath.Join(env.dir, "does-not-exist.json")
+	if err := env.f.TriggerRefresh([]*Daemon{env.daemon}, options); err == nil {
+		t.Error("missing config file: no error")
+	}
+
+	env.launcher.err = errors.New("no such binary")
+	options = env.options(0)
+	options.LogstashEndpoint = "other:5043"
+	if err := env.f.TriggerRefresh([]*Daemon{env.daemon}, options); err == nil {
+		t.Error("launch failing: no error")
+	}
+}
+
+// inspectCountingClient counts inspected containers and pretends those in removed do not exist.
+type inspectCountingClient struct {
+	DockerClient
+	inspected map[string]int
+	removed   map[string]bool
+}
+
+func (client *inspectCountingClient) InspectContainer(id string) (*docker.Container, error) {
+	client.inspected[id]++
+	if client.removed[id] {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	return client.DockerClient.InspectContainer(id)
+}
+
+func TestRefreshDaemonSkipsContainers(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+
+	env.server.Start(newContainer("running"))
+	env.server.Start(newContainer("removed"))
+	env.server.Create(newContainer("created"))
+	exitedLongAgo := newContainer("exited")
+	exitedLongAgo.State = docker.State{StartedAt: time.Now().Add(-3 * time.Hour), FinishedAt: time.Now().Add(-2 * time.Hour)}
+	env.server.Create(exitedLongAgo)
+
+	client := &inspectCountingClient{DockerClient: env.daemon.Client, inspected: map[string]int{}, removed: map[string]bool{"removed": true}}
+	env.daemon.Client = client
+	env.refresh(time.Hour)
+
+	want := map[string]int{"running": 1, "removed": 1}
+	if !reflect.DeepEqual(client.inspected, want) {
+		t.Errorf("inspected %v, want %v", client.inspected, want)
+	}
+	if shipped := env.f.shipped[config.DefaultDestination]; len(shipped) != 1 {
+		t.Errorf("shipping %v, want only the running container", shipped)
+	}
+}
+
+func TestExitedFor(t *testing.T) {
+	tests := []struct {
+		status string
+		want   time.Duration
+		ok     bool
+	}{
+		{"Up 5 minutes", 0, false},
+		{"Created", 0, false},
+		{"Exited (0) Less than a second ago", 0, true},
+		{"Exited (1) 1 second ago", time.Second, true},
+		{"Exited (137) 42 seconds ago", 42 * time.Second, true},
+		{"Exited (0) About a minute ago", time.Minute, true},
+		{"Exited (0) 45 minutes ago", 45 * time.Minute, true},
+		{"Exited (0) About an hour ago", 46 * time.Minute, true},
+		{"Exited (-1) 3 hours ago", 150 * time.Minute, true},
+		{"Exited (0) 2 days ago", 47*time.Hour + 30*time.Minute, true},
+		{"Exited (0) 3 weeks ago", 21*24*time.Hour - 30*time.Minute, true},
+		{"Exited (0) 4 months ago", 120*24*time.Hour - 30*time.Minute, true},
+		{"Exited (0) 2 years ago", 730 * 24 * time.Hour, true},
+		{"Exited (0) a while ago", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := exitedFor(test.status)
+		if got != test.want || ok != test.ok {
+			t.Errorf("exitedFor(%q) = %s, %t, want %s, %t", test.status, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestImageDigests(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.close()
+
+	container := newContainer("abc")
+	container.Image = "sha256:1234"
+	env.server.AddImage(&docker.Image{ID: container.Image, RepoDigests: []string{"web@sha256:bbbb", "registry/web@sha256:aaaa", "mirror/web@sha256:bbbb"}})
+	env.server.Start(container)
+	local := newContainer("def")
+	local.Image = "sha256:5678"
+	env.server.AddImage(&docker.Image{ID: local.Image})
+	env.server.Start(local)
+
+	options := env.options(0)
+	options.Metadata.Groups = map[string]bool{config.GroupRuntime: true}
+	destinations, _, err := collect([]*Daemon{env.daemon}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests := map[string]string{}
+	for _, c := range destinations[config.DefaultDestination].Containers {
+		digests[c.ID] = c.LogFile.Fields["docker/image/digest"]
+	}
+	if want := map[string]string{"abc": "sha256:aaaa,sha256:bbbb", "def": ""}; !reflect.DeepEqual(digests, want) {
+		t.Errorf("got digests %v, want %v", digests, want)
+	}
+}
+
+func TestContainerFileFieldPrecedence(t *testing.T) {
+	daemon := &Daemon{Name: "daemon-1"}
+	node := &docker.SwarmNode{Name: "node-1"}
+
+	tests := []struct {
+		name   string
+		schema *config.Schema
+		node   *docker.SwarmNode
+		own    map[string]string
+		want   map[string]string
+	}{
+		{"legacy", &config.LegacySchema, nil, nil, map[string]string{"host": "web", "docker/daemon": "daemon-1"}},
+		{"legacy with own fields", &config.LegacySchema, nil, map[string]string{"host": "app", "docker/daemon": "mine"}, map[string]string{"host": "app", "docker/daemon": "mine"}},
+		{"ecs", &config.ECSSchema, nil, nil, map[string]string{"host.name": "web", "host": "", "host.hostname": "daemon-1"}},
+		// the swarm node name is metadata, so it takes precedence over the host default
+		{"ecs with swarm node", &config.ECSSchema, node, nil, map[string]string{"host.name": "node-1"}},
+	}
+	for _, test := range tests {
+		container := newContainer("abc")
+		container.Node = test.node
+		file := containerFile(daemon, container, config.File{Paths: []string{"/a"}, Fields: test.own}, &config.Metadata{Schema: test.schema})
+		for k, v := range test.want {
+			if file.Fields[k] != v {
+				t.Errorf("%s: %s = %q, want %q", test.name, k, file.Fields[k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package forwarder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// writeFragments writes one fragment per container of destination into destination.FragmentsDir
+// and removes the fragments of all other containers. Only fragments whose content changed are written.
+//
+// It reports whether any fragment was written or removed.
+func writeFragments(tmpl *template.Template, extension string, destination *Destination) (bool, error) {
+	dir := destination.FragmentsDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+
+	changed := false
+	current := make(map[string]bool)
+	for _, c := range destination.Containers {
+		name := c.ID + extension
+		current[name] = true
+
+		rendered, err := renderFragment(tmpl, destination, c)
+		if err != nil {
+			return changed, err
+		}
+
+		path := filepath.Join(dir, name)
+		if existing, err := ioutil.ReadFile(path); err == nil && bytes.Equal(existing, rendered) {
+			continue
+		}
+		if err := writeAtomically(path, rendered); err != nil {
+			return changed, err
+		}
+		log.Info("Wrote fragment for %s to %s", c.ID, path)
+		changed = true
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return changed, err
+	}
+	for _, entry := range entries {
+		if current[entry.Name()] || !strings.HasSuffix(entry.Name(), extension) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil {
+			return changed, err
+		}
+		log.Info("Removed stale fragment %s", path)
+		changed = true
+	}
+	return changed, nil
+}
+
+// renderFragment renders the fragment of container c of destination.
+func renderFragment(tmpl *template.Template, destination *Destination, c *Container) ([]byte, error) {
+	fragment := *destination
+	fragment.Containers = []*Container{c}
+	return render(tmpl, &fragment)
+}
+
+// removeStaleFragmentDirs removes the fragments directories of all destinations not in names
+// or empty, so their fragments are not picked up again.
+func removeStaleFragmentDirs(dir string, names map[string]*Destination) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if destination, ok := names[entry.Name()]; (ok && !destination.isEmpty()) || !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			log.Error("Unable to remove stale fragments %s: %s", path, err)
+		} else {
+			log.Info("Removed stale fragments %s", path)
+		}
+	}
+}
+
+// writeAtomically writes content to a temporary file next to path and renames it to path,
+// so watching shippers never see partially written files.
+func writeAtomically(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
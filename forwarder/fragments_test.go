@@ -0,0 +1,47 @@
+package forwarder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+)
+
+func TestFragments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fragments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := config.File{Paths: []string{"/a"}, Fields: map[string]string{"type": "docker"}}
+	audit := &Destination{
+		Name:         "audit",
+		Containers:   []*Container{{ID: "abc", LogFile: &file}},
+		Config:       &config.LogstashForwarderConfig{Files: []config.File{file}},
+		FragmentsDir: filepath.Join(dir, "audit"),
+	}
+	changed, err := writeFragments(promtailFragmentTemplate, ".json", audit)
+	if err != nil || !changed {
+		t.Fatalf("writeFragments() = %t, %v", changed, err)
+	}
+	if changed, err = writeFragments(promtailFragmentTemplate, ".json", audit); err != nil || changed {
+		t.Errorf("unchanged writeFragments() = %t, %v", changed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit", "abc.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	removeStaleFragmentDirs(dir, map[string]*Destination{"audit": audit})
+	if _, err := os.Stat(filepath.Join(dir, "audit")); err != nil {
+		t.Errorf("fragments of non empty destination removed: %s", err)
+	}
+
+	empty := &Destination{Name: "audit", Config: &config.LogstashForwarderConfig{}}
+	removeStaleFragmentDirs(dir, map[string]*Destination{"audit": empty})
+	if _, err := os.Stat(filepath.Join(dir, "audit")); !os.IsNotExist(err) {
+		t.Errorf("fragments of empty destination kept: %v", err)
+	}
+}
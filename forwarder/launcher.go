@@ -0,0 +1,42 @@
+package forwarder
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Launcher starts backend instances.
+type Launcher interface {
+	Launch(cmd *exec.Cmd) (Process, error)
+}
+
+// Process is a running backend instance.
+type Process interface {
+	Pid() int
+	Signal(sig os.Signal) error
+	Kill() error
+	// Wait blocks until the process exited.
+	Wait() error
+}
+
+// ExecLauncher runs backend instances as child processes sharing stdout & stderr.
+type ExecLauncher struct{}
+
+// Launch implements Launcher.
+func (ExecLauncher) Launch(cmd *exec.Cmd) (Process, error) {
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return execProcess{cmd}, nil
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p execProcess) Pid() int                   { return p.cmd.Process.Pid }
+func (p execProcess) Signal(sig os.Signal) error { return p.cmd.Process.Signal(sig) }
+func (p execProcess) Kill() error                { return p.cmd.Process.Kill() }
+func (p execProcess) Wait() error                { return p.cmd.Wait() }
@@ -0,0 +1,179 @@
+package forwarder
+
+import (
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+)
+
+// promtailTemplate renders a Promtail config with one scrape config per file section, keeping
+// the positions in the state directory. HTTPS is used if any ssl file is configured.
+//
+// The fields selected via -backend-option loki_labels (defaultLokiLabels if not set) become Loki labels,
+// all other fields are attached as structured metadata to keep the label cardinality low.
+var promtailTemplate = template.Must(NewTemplate("promtail", `server:
+  disable: true
+
+positions:
+  filename: {{ .StateDir }}/positions.yaml
+
+clients:
+{{ range .Network.Servers }}  - url: {{ if index $.Settings "loki_url" }}{{ index $.Settings "loki_url" }}{{ else }}{{ if $.Network.SslFiles }}https{{ else }}http{{ end }}://{{ . }}/loki/api/v1/push{{ end }}
+{{ if $.Network.SslFiles }}    tls_config:
+{{ with $.Network.SslCertificate }}      cert_file: {{ . }}
+{{ end }}{{ with $.Network.SslKey }}      key_file: {{ . }}
+{{ end }}{{ with $.Network.SslCa }}      ca_file: {{ . }}
+{{ end }}{{ end }}{{ end }}
+scrape_configs:
+{{ if .FragmentsDir }}  - job_name: fragments
+    pipeline_stages:
+      - match:
+          selector: '{`+dockerFormatLabel+`="docker"}'
+          stages:
+            - docker: {}
+      - labeldrop: [ `+dockerFormatLabel+` ]
+    file_sd_configs:
+      - files: [ {{ toJSON (print .FragmentsDir "/*.json") }} ]
+{{ else }}{{ range $c := .Containers }}{{ with $c.LogFile }}  - job_name: docker-{{ $c.ID }}
+{{ template "scrape" (scrape . $.Settings "docker") }}{{ end }}{{ range $i, $f := $c.Files }}  - job_name: file-{{ $c.ID }}-{{ $i }}
+{{ template "scrape" (scrape $f $.Settings "") }}{{ end }}{{ end }}{{ end }}{{ range $i, $f := .HostFiles }}  - job_name: host-{{ $i }}
+{{ template "scrape" (scrape $f $.Settings "") }}{{ end }}
+{{- define "scrape" }}{{ if or .Stage .Metadata }}    pipeline_stages:
+{{ end }}{{ if .Stage }}      - {{ .Stage }}: {}
+{{ end }}{{ range $k, $v := .Metadata }}      - template:
+          source: {{ $k }}
+          template: {{ toJSON $v }}
+{{ end }}{{ if .Metadata }}      - structured_metadata:
+{{ range $k, $v := .Metadata }}          {{ $k }}:
+{{ end }}{{ end }}    static_configs:
+{{ range .Paths }}      - targets: [ localhost ]
+        labels:
+          __path__: {{ toJSON . }}
+{{ range $k, $v := $.Labels }}          {{ $k }}: {{ toJSON $v }}
+{{ end }}{{ end }}{{ end }}`))
+
+// dockerFormatLabel marks the targets of docker log files in fragments, so only those are parsed
+// with the docker stage. It is dropped before shipping.
+const dockerFormatLabel = "dlf_format"
+
+// promtailFragmentTemplate renders the file_sd targets of a single container.
+//
+// Only Loki labels can be set via file_sd, so structured metadata is not available in fragments mode.
+var promtailFragmentTemplate = template.Must(NewTemplate("promtail-fragment", "{{ toJSON (targets .) }}\n"))
+
+// defaultLokiLabels are the fields (of all builtin schemas) turned into Loki labels.
+var defaultLokiLabels = []string{
+	"type",
+	"docker/name", "docker/image", "docker/node/name",
+	"container.name", "container.image.name", "host.name",
+	"compose/project", "compose/service",
+	"compose.project", "compose.service",
+}
+
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// templateEscaper turns a value into a promtail template stage rendering the value as is.
+var templateEscaper = strings.NewReplacer("{{", `{{ "{{" }}`, "}}", `{{ "}}" }}`)
+
+// promtailScrape is the data the scrape template gets rendered with.
+type promtailScrape struct {
+	Stage    string
+	Paths    []string
+	Labels   map[string]string
+	Metadata map[string]string
+}
+
+// scrape splits the fields of a file section into Loki labels & structured metadata.
+//
+// Structured metadata is set via template stages, so its values get their template delimiters escaped.
+func scrape(file interface{}, settings map[string]string, stage string) promtailScrape {
+	var paths []string
+	var fields map[string]string
+	switch f := file.(type) {
+	case *config.File:
+		paths, fields = f.Paths, f.Fields
+	case config.File:
+		paths, fields = f.Paths, f.Fields
+	}
+
+	labelFields := defaultLokiLabels
+	if names := settings["loki_labels"]; names != "" {
+		labelFields = strings.Split(names, ",")
+	}
+
+	s := promtailScrape{
+		Stage:    stage,
+		Paths:    paths,
+		Labels:   make(map[string]string),
+		Metadata: make(map[string]string),
+	}
+	for k, v := range fields {
+		if k == "codec" {
+			continue
+		}
+		name := lokiName(k)
+		if contains(labelFields, k) {
+			s.Labels[name] = v
+		} else {
+			s.Metadata[name] = templateEscaper.Replace(v)
+		}
+	}
+	return s
+}
+
+// promtailTarget is a file_sd target group.
+type promtailTarget struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// targets returns one target group per path of all file sections of destination, those of
+// docker log files labeled with dockerFormatLabel.
+func targets(destination *Destination) []promtailTarget {
+	groups := []promtailTarget{}
+	for _, c := range destination.Containers {
+		if c.LogFile != nil {
+			groups = appendTargets(groups, *c.LogFile, destination.Settings, map[string]string{dockerFormatLabel: "docker"})
+		}
+		for _, file := range c.Files {
+			groups = appendTargets(groups, file, destination.Settings, nil)
+		}
+	}
+	return groups
+}
+
+// appendTargets appends one target group per path of file, labeled with its Loki labels and extra.
+func appendTargets(groups []promtailTarget, file config.File, settings map[string]string, extra map[string]string) []promtailTarget {
+	s := scrape(file, settings, "")
+	for _, path := range s.Paths {
+		labels := map[string]string{"__path__": path}
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		for k, v := range extra {
+			labels[k] = v
+		}
+		groups = append(groups, promtailTarget{Targets: []string{"localhost"}, Labels: labels})
+	}
+	return groups
+}
+
+// lokiName turns a field name into a valid Loki label name.
+func lokiName(field string) string {
+	name := invalidLabelChars.ReplaceAllString(field, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
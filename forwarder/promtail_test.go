@@ -0,0 +1,81 @@
+package forwarder
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+)
+
+func TestScrapeEscapesMetadata(t *testing.T) {
+	values := []string{"plain", "{{ .Value }}", "a}}b{{c", `{{ "{{" }}`}
+	for _, value := range values {
+		s := scrape(config.File{Fields: map[string]string{"docker/id": value}}, nil, "")
+		// promtail renders the template stage with Go templates.
+		tmpl, err := template.New("stage").Parse(s.Metadata["docker_id"])
+		if err != nil {
+			t.Errorf("%q: %s", value, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, map[string]string{"Value": "evaluated"}); err != nil {
+			t.Errorf("%q: %s", value, err)
+			continue
+		}
+		if buf.String() != value {
+			t.Errorf("%q renders as %q", value, buf.String())
+		}
+	}
+}
+
+func TestTargetsMarkDockerLogFiles(t *testing.T) {
+	logFile := config.File{Paths: []string{"/docker.log"}, Fields: map[string]string{"type": "docker"}}
+	destination := &Destination{Containers: []*Container{{
+		ID:      "abc",
+		LogFile: &logFile,
+		Files:   []config.File{{Paths: []string{"/app.log"}, Fields: map[string]string{"type": "app"}}},
+	}}}
+
+	groups := targets(destination)
+	if len(groups) != 2 {
+		t.Fatalf("got %d target groups, want 2", len(groups))
+	}
+	for _, group := range groups {
+		docker := group.Labels["__path__"] == "/docker.log"
+		if (group.Labels[dockerFormatLabel] == "docker") != docker {
+			t.Errorf("%s labeled %q", group.Labels["__path__"], group.Labels[dockerFormatLabel])
+		}
+	}
+}
+
+func TestPromtailTemplate(t *testing.T) {
+	tests := []struct {
+		network  config.Network
+		want     []string
+		unwanted []string
+	}{
+		{config.Network{Servers: []string{"loki:3100"}}, []string{"url: http://loki:3100/"}, []string{"tls_config"}},
+		{config.Network{Servers: []string{"loki:3100"}, SslCa: "/ca.crt"}, []string{"url: https://loki:3100/", "tls_config:\n      ca_file: /ca.crt\n"}, []string{"cert_file"}},
+		{config.Network{Servers: []string{"loki:3100"}, SslCertificate: "/c.crt", SslKey: "/c.key"}, []string{"url: https://loki:3100/", "cert_file: /c.crt\n", "key_file: /c.key\n"}, []string{"ca_file"}},
+	}
+	for _, test := range tests {
+		destination := &Destination{Name: config.DefaultDestination, Network: test.network, Config: &config.LogstashForwarderConfig{}, StateDir: "/state/default"}
+		rendered, err := render(promtailTemplate, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := string(rendered)
+		for _, want := range append(test.want, "filename: /state/default/positions.yaml\n") {
+			if !strings.Contains(conf, want) {
+				t.Errorf("config does not contain %q:\n%s", want, conf)
+			}
+		}
+		for _, unwanted := range test.unwanted {
+			if strings.Contains(conf, unwanted) {
+				t.Errorf("config contains %q:\n%s", unwanted, conf)
+			}
+		}
+	}
+}
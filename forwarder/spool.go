@@ -0,0 +1,422 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+)
+
+// spoolInterval is how often docker log files are checked for new lines.
+const spoolInterval = time.Second
+
+// spoolMaxSize is the size after which a spool file is rotated to <file>.1.
+var spoolMaxSize int64 = 10 << 20
+
+// sourceFile is written to every spool directory, naming the docker log file spooled. Only
+// directories containing it are ever removed.
+const sourceFile = "source"
+
+// containerID matches the full ID of a container, the name of every spool directory.
+var containerID = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// spooler demultiplexes docker log files into one spool file per stream, for shippers which
+// can not split a file by themselves.
+type spooler struct {
+	dir   string
+	mu    sync.Mutex
+	tails map[string]*tail
+
+	registryMu sync.Mutex
+	// registry returns how far the shipper read every spool file, nil if it does not keep a registry.
+	registry func() map[string]int64
+}
+
+// tail copies the lines of one docker log file to the spool files of their streams.
+type tail struct {
+	id      string
+	source  string
+	dir     string
+	streams map[string]bool
+
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64
+	partial []byte
+	spools  map[string]*os.File
+
+	// read returns how far the shipper read every spool file, nil if unknown.
+	read func() map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSpooler(dir string) *spooler {
+	return &spooler{dir: dir, tails: make(map[string]*tail)}
+}
+
+// sync starts demultiplexing all docker log files of jobs not demultiplexed yet and stops all others.
+//
+// The spool files of stopped jobs are kept until their container got removed (so its docker log file is gone)
+// or registry shows they were read completely. Registry may be nil if the shipper does not keep one.
+func (s *spooler) sync(jobs map[string]*tail, registry func() map[string]int64) {
+	s.registryMu.Lock()
+	s.registry = registry
+	s.registryMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.tails {
+		if job, ok := jobs[id]; !ok || job.source != t.source || !sameStreams(job.streams, t.streams) {
+			t.halt()
+			delete(s.tails, id)
+			if !ok {
+				log.Info("Stopped spooling %s", id)
+			}
+		}
+	}
+	for id, job := range jobs {
+		if _, ok := s.tails[id]; ok {
+			continue
+		}
+		if !containerID.MatchString(id) {
+			log.Error("Not spooling %s, it is no container ID", id)
+			continue
+		}
+		job.dir = filepath.Join(s.dir, id)
+		if err := os.MkdirAll(job.dir, 0755); err != nil {
+			log.Error("Unable to create spool directory %s: %s", job.dir, err)
+			continue
+		}
+		if err := writeAtomically(filepath.Join(job.dir, sourceFile), []byte(job.source+"\n")); err != nil {
+			log.Error("Unable to create spool directory %s: %s", job.dir, err)
+			continue
+		}
+		job.read = s.read
+		job.stop = make(chan struct{})
+		job.done = make(chan struct{})
+		s.tails[id] = job
+		go job.run()
+		log.Info("Spooling %s of %s to %s", streamNames(job.streams), id, job.dir)
+	}
+
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if _, ok := s.tails[entry.Name()]; ok || !entry.IsDir() || !containerID.MatchString(entry.Name()) {
+			continue
+		}
+		dir := filepath.Join(s.dir, entry.Name())
+		content, err := ioutil.ReadFile(filepath.Join(dir, sourceFile))
+		if err != nil {
+			continue
+		}
+		source := strings.TrimSpace(string(content))
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			log.Info("Removing spool files of %s, its docker log file is gone", entry.Name())
+		} else if spoolDrained(dir, source, s.read()) {
+			log.Info("Removing spool files of %s, they were read completely", entry.Name())
+		} else {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Error("Unable to remove spool directory %s: %s", dir, err)
+		}
+	}
+}
+
+// read returns the registry of the shipper, nil if unknown.
+func (s *spooler) read() map[string]int64 {
+	s.registryMu.Lock()
+	registry := s.registry
+	s.registryMu.Unlock()
+	if registry == nil {
+		return nil
+	}
+	return registry()
+}
+
+// spoolDrained reports whether the docker log file source was spooled to dir completely
+// and all spool files were read completely according to registry.
+func spoolDrained(dir string, source string, registry map[string]int64) bool {
+	if registry == nil {
+		return false
+	}
+	info, err := os.Stat(source)
+	if err != nil || readOffset(dir) < info.Size() {
+		return false
+	}
+	for _, stream := range config.Streams {
+		path := filepath.Join(dir, stream+".log")
+		for _, spool := range []string{path, path + ".1"} {
+			if !read(spool, registry) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// read reports whether the file at path does not exist or was read completely according to registry.
+func read(path string, registry map[string]int64) bool {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	offset, ok := registry[path]
+	return err == nil && ok && offset >= info.Size()
+}
+
+// halt stops all tails, keeping their spool files & offsets.
+func (s *spooler) halt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.tails {
+		t.halt()
+		delete(s.tails, id)
+	}
+}
+
+func (t *tail) halt() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *tail) run() {
+	defer close(t.done)
+	defer t.close()
+
+	t.offset = readOffset(t.dir)
+	ticker := time.NewTicker(spoolInterval)
+	defer ticker.Stop()
+	for {
+		if err := t.poll(); err != nil && !os.IsNotExist(err) {
+			log.Warning("Unable to spool %s: %s", t.source, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// poll copies all complete lines written since the last poll, following rotations of the source.
+func (t *tail) poll() error {
+	if t.file == nil {
+		file, err := os.Open(t.source)
+		if err != nil {
+			return err
+		}
+		if info, err := file.Stat(); err == nil && info.Size() < t.offset {
+			t.offset = 0
+		}
+		if _, err := file.Seek(t.offset, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+		t.file, t.reader = file, bufio.NewReader(file)
+	}
+
+	if err := t.copy(); err != nil {
+		return err
+	}
+
+	current, err := os.Stat(t.source)
+	if err != nil {
+		return err
+	}
+	opened, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(current, opened) || current.Size() < t.offset {
+		// the source got rotated (or truncated): drain the old file, continue with the new one.
+		if err := t.copy(); err != nil {
+			return err
+		}
+		t.file.Close()
+		t.file, t.reader, t.offset, t.partial = nil, nil, 0, nil
+	}
+	return t.saveOffset()
+}
+
+// copy writes all complete lines up to the end of the source to the spool files of their streams.
+func (t *tail) copy() error {
+	for {
+		line, err := t.reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			complete := line
+			if len(t.partial) > 0 {
+				complete = append(t.partial, line...)
+			}
+			if err := t.write(complete); err != nil {
+				t.rewind()
+				return err
+			}
+			t.offset += int64(len(line))
+			t.partial = nil
+		} else if len(line) > 0 {
+			t.offset += int64(len(line))
+			t.partial = append(t.partial, line...)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rewind seeks back to the start of the line which could not be written, so the next poll reads it again.
+func (t *tail) rewind() {
+	t.offset -= int64(len(t.partial))
+	t.partial = nil
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		// reopen the source on the next poll instead
+		t.file.Close()
+		t.file, t.reader = nil, nil
+		return
+	}
+	t.reader.Reset(t.file)
+}
+
+func (t *tail) write(line []byte) error {
+	var entry struct {
+		Stream string `json:"stream"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+		log.Debug("Skipping malformed line of %s: %s", t.source, err)
+		return nil
+	}
+	if !t.streams[entry.Stream] {
+		return nil
+	}
+
+	spool, err := t.spool(entry.Stream)
+	if err != nil {
+		return err
+	}
+	_, err = spool.Write(line)
+	return err
+}
+
+// spool returns the spool file of stream, rotating it once it exceeds spoolMaxSize - unless
+// the shipper keeps a registry showing the previous rotation was not read completely yet.
+func (t *tail) spool(stream string) (*os.File, error) {
+	if t.spools == nil {
+		t.spools = make(map[string]*os.File)
+	}
+	path := filepath.Join(t.dir, stream+".log")
+
+	if spool, ok := t.spools[stream]; ok {
+		info, err := spool.Stat()
+		if err != nil || info.Size() < spoolMaxSize {
+			return spool, err
+		}
+		if registry := t.read(); registry != nil && !read(path+".1", registry) {
+			log.Debug("Not rotating %s, %s.1 was not read completely yet", path, path)
+			return spool, nil
+		}
+		spool.Close()
+		delete(t.spools, stream)
+		if err := os.Rename(path, path+".1"); err != nil {
+			return nil, err
+		}
+	}
+
+	spool, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t.spools[stream] = spool
+	return spool, nil
+}
+
+func (t *tail) close() {
+	if t.file != nil {
+		t.file.Close()
+	}
+	for _, spool := range t.spools {
+		spool.Close()
+	}
+}
+
+// readOffset returns how far the source spooled to dir was spooled before, excluding a trailing partial line.
+func readOffset(dir string) int64 {
+	content, err := ioutil.ReadFile(filepath.Join(dir, "offset"))
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return offset
+}
+
+func (t *tail) saveOffset() error {
+	offset := t.offset - int64(len(t.partial))
+	return writeAtomically(filepath.Join(t.dir, "offset"), []byte(strconv.FormatInt(offset, 10)+"\n"))
+}
+
+// spoolJobs returns one tail per container of destinations with split streams.
+func spoolJobs(destinations map[string]*Destination) map[string]*tail {
+	jobs := make(map[string]*tail)
+	for _, destination := range destinations {
+		for _, c := range destination.Containers {
+			if _, ok := jobs[c.ID]; ok || c.Docker == nil || strings.EqualFold(c.Labels[config.SkipDockerLogLabel], "true") {
+				continue
+			}
+			streams := make(map[string]bool)
+			for _, stream := range config.Streams {
+				if !config.SkipStream(c.Docker, stream) {
+					streams[stream] = true
+				}
+			}
+			if len(streams) == 0 {
+				continue
+			}
+			jobs[c.ID] = &tail{id: c.ID, source: config.ContainerLogPath(c.Docker, c.DataRoot), streams: streams}
+		}
+	}
+	return jobs
+}
+
+func sameStreams(a map[string]bool, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for stream := range a {
+		if !b[stream] {
+			return false
+		}
+	}
+	return true
+}
+
+func streamNames(streams map[string]bool) []string {
+	names := []string{}
+	for _, stream := range config.Streams {
+		if streams[stream] {
+			names = append(names, stream)
+		}
+	}
+	return names
+}
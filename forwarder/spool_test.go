@@ -0,0 +1,275 @@
+package forwarder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const spoolTestID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func stdout(line string) string {
+	return `{"log":"` + line + `\n","stream":"stdout"}` + "\n"
+}
+
+func stderr(line string) string {
+	return `{"log":"` + line + `\n","stream":"stderr"}` + "\n"
+}
+
+// newTestTail returns a tail spooling both streams of source to dir, polled by the test itself.
+func newTestTail(t *testing.T, dir string, registry map[string]int64) *tail {
+	spoolDir := filepath.Join(dir, "spool", spoolTestID)
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tail := &tail{
+		id:      spoolTestID,
+		source:  filepath.Join(dir, "source.log"),
+		dir:     spoolDir,
+		streams: map[string]bool{"stdout": true, "stderr": true},
+		read:    func() map[string]int64 { return registry },
+	}
+	tail.offset = readOffset(spoolDir)
+	return tail
+}
+
+func appendFile(t *testing.T, path string, content string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func poll(t *testing.T, tail *tail) {
+	if err := tail.poll(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertFile(t *testing.T, step string, path string, want string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if string(content) != want {
+		t.Errorf("%s: %s contains %q, want %q", step, filepath.Base(path), content, want)
+	}
+}
+
+func TestTailSplitsStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tail := newTestTail(t, dir, nil)
+	defer tail.close()
+	stdoutPath := filepath.Join(tail.dir, "stdout.log")
+	stderrPath := filepath.Join(tail.dir, "stderr.log")
+
+	appendFile(t, tail.source, stdout("a")+stderr("b"))
+	poll(t, tail)
+	assertFile(t, "split", stdoutPath, stdout("a"))
+	assertFile(t, "split", stderrPath, stderr("b"))
+
+	// partial lines are only spooled once complete, the offset excludes them until then
+	line := stdout("c")
+	appendFile(t, tail.source, line[:10])
+	poll(t, tail)
+	assertFile(t, "partial line", stdoutPath, stdout("a"))
+	assertFile(t, "partial line", filepath.Join(tail.dir, "offset"), fmt.Sprintf("%d\n", len(stdout("a")+stderr("b"))))
+	appendFile(t, tail.source, line[10:])
+	poll(t, tail)
+	assertFile(t, "completed line", stdoutPath, stdout("a")+stdout("c"))
+
+	// rotated sources are drained before continuing with the new one
+	appendFile(t, tail.source, stdout("d"))
+	if err := os.Rename(tail.source, tail.source+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, tail.source, stdout("e"))
+	poll(t, tail)
+	poll(t, tail)
+	assertFile(t, "rotation", stdoutPath, stdout("a")+stdout("c")+stdout("d")+stdout("e"))
+
+	// truncated sources are read from the start
+	if err := ioutil.WriteFile(tail.source, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	poll(t, tail)
+	appendFile(t, tail.source, stderr("f"))
+	poll(t, tail)
+	assertFile(t, "truncation", stderrPath, stderr("b")+stderr("f"))
+	tail.close()
+
+	// a new tail continues where the last one stopped
+	appendFile(t, tail.source, stderr("g"))
+	resumed := newTestTail(t, dir, nil)
+	defer resumed.close()
+	poll(t, resumed)
+	assertFile(t, "resumed", stderrPath, stderr("b")+stderr("f")+stderr("g"))
+}
+
+func TestTailRetriesFailedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tail := newTestTail(t, dir, nil)
+	defer tail.close()
+	stdoutPath := filepath.Join(tail.dir, "stdout.log")
+	stderrPath := filepath.Join(tail.dir, "stderr.log")
+
+	line := stderr("b")
+	appendFile(t, tail.source, stdout("a")+line[:10])
+	poll(t, tail)
+
+	// a directory in place of the spool file makes writing the completed line fail
+	if err := os.Mkdir(stderrPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, tail.source, line[10:])
+	if err := tail.poll(); err == nil {
+		t.Fatal("writing to a directory succeeded")
+	}
+	if tail.offset != int64(len(stdout("a"))) {
+		t.Errorf("failed write: offset is %d, want %d", tail.offset, len(stdout("a")))
+	}
+
+	if err := os.Remove(stderrPath); err != nil {
+		t.Fatal(err)
+	}
+	poll(t, tail)
+	assertFile(t, "retry", stdoutPath, stdout("a"))
+	assertFile(t, "retry", stderrPath, line)
+}
+
+func TestTailRotatesReadSpoolFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	maxSize := spoolMaxSize
+	spoolMaxSize = int64(len(stdout("a")))
+	defer func() { spoolMaxSize = maxSize }()
+
+	registry := map[string]int64{}
+	tail := newTestTail(t, dir, registry)
+	defer tail.close()
+	path := filepath.Join(tail.dir, "stdout.log")
+
+	appendFile(t, tail.source, stdout("a")+stdout("b"))
+	poll(t, tail)
+	assertFile(t, "first rotation", path+".1", stdout("a"))
+	assertFile(t, "first rotation", path, stdout("b"))
+
+	appendFile(t, tail.source, stdout("c"))
+	poll(t, tail)
+	assertFile(t, "previous rotation unread", path+".1", stdout("a"))
+	assertFile(t, "previous rotation unread", path, stdout("b")+stdout("c"))
+
+	registry[path+".1"] = spoolMaxSize
+	appendFile(t, tail.source, stdout("d"))
+	poll(t, tail)
+	assertFile(t, "previous rotation read", path+".1", stdout("b")+stdout("c"))
+	assertFile(t, "previous rotation read", path, stdout("d"))
+}
+
+func TestSpoolerRemovesOnlyOwnDrainedDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source.log")
+	appendFile(t, source, stdout("a"))
+	spoolDir := func(name string, source string) string {
+		path := filepath.Join(dir, "spool", name)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if source != "" {
+			appendFile(t, filepath.Join(path, sourceFile), source+"\n")
+		}
+		return path
+	}
+	removed := strings.Replace(spoolTestID, "0", "1", -1)
+	unread := strings.Replace(spoolTestID, "0", "2", -1)
+	read := strings.Replace(spoolTestID, "0", "3", -1)
+	dirs := map[string]bool{
+		spoolDir("not-an-id", filepath.Join(dir, "gone.log")): true,
+		spoolDir(strings.Repeat("a", 64), ""):                 true,
+		spoolDir(removed, filepath.Join(dir, "gone.log")):     false,
+		spoolDir(unread, source):                              true,
+		spoolDir(read, source):                                false,
+	}
+	for _, id := range []string{unread, read} {
+		appendFile(t, filepath.Join(dir, "spool", id, "offset"), fmt.Sprintf("%d\n", len(stdout("a"))))
+		appendFile(t, filepath.Join(dir, "spool", id, "stdout.log"), stdout("a"))
+	}
+	registry := map[string]int64{filepath.Join(dir, "spool", read, "stdout.log"): int64(len(stdout("a")))}
+
+	s := newSpooler(filepath.Join(dir, "spool"))
+	s.sync(map[string]*tail{}, nil)
+	for path := range dirs {
+		if _, err := os.Stat(path); err != nil && filepath.Base(path) != removed {
+			t.Errorf("without registry: %s got removed", filepath.Base(path))
+		}
+	}
+
+	s.sync(map[string]*tail{}, func() map[string]int64 { return registry })
+	for path, kept := range dirs {
+		if _, err := os.Stat(path); (err == nil) != kept {
+			t.Errorf("with registry: %s kept %t, want %t", filepath.Base(path), err == nil, kept)
+		}
+	}
+}
+
+func TestDrainedWithSplitStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	container := &docker.Container{ID: spoolTestID}
+	root := config.DataRoot{Local: dir}
+	source := config.ContainerLogPath(container, root)
+	if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, source, stdout("a"))
+	options := Options{SpoolDir: filepath.Join(dir, "spool"), registry: map[string]int64{source: int64(len(stdout("a")))}}
+	tail := newTestTail(t, dir, nil)
+	defer tail.close()
+	tail.source = source
+	spool := filepath.Join(tail.dir, "stdout.log")
+
+	if drained(container, root, options) {
+		t.Error("drained before spooling")
+	}
+	poll(t, tail)
+	if drained(container, root, options) {
+		t.Error("drained before the spool file was read")
+	}
+	options.registry[spool] = int64(len(stdout("a")))
+	if !drained(container, root, options) {
+		t.Error("not drained after the spool file was read")
+	}
+}
@@ -0,0 +1,115 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder/config"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// Container describes a discovered container to templates.
+type Container struct {
+	ID       string
+	Name     string
+	Hostname string
+	Image    string
+	Labels   map[string]string
+	// Daemon is the name of the docker daemon running the container, if watching multiple daemons.
+	Daemon   string
+	DataRoot config.DataRoot
+	// LogFile is the file section of the containers docker log file, nil if it is not shipped.
+	LogFile *config.File
+	// Files are the file sections of the in container config, with paths already resolved and
+	// container metadata added, preceded by the per stream spool files if splitting streams.
+	Files []config.File
+	// Docker is the raw result of inspecting the container.
+	Docker *docker.Container
+}
+
+// Destination is the data a template gets rendered with - one per backend instance.
+type Destination struct {
+	Name       string
+	Network    config.Network
+	Containers []*Container
+	// HostFiles are the file sections of the host files of the wrapper config shipped to this destination.
+	HostFiles []config.File
+	// Config is the logstash-forwarder config containing all files of this destination.
+	Config *config.LogstashForwarderConfig
+	// Settings are the backend options passed via -backend-option.
+	Settings map[string]string
+	// FragmentsDir is the directory containing one fragment per container, if running with -fragments.
+	FragmentsDir string
+	// StateDir is the working directory of the backend instance, to keep its registry in.
+	StateDir string
+}
+
+// isEmpty reports whether no backend instance needs to run for this destination,
+// which is the case for all destinations but the default one without any files.
+func (destination *Destination) isEmpty() bool {
+	return destination.Name != config.DefaultDestination && len(destination.Config.Files) == 0
+}
+
+// DefaultTemplate renders the logstash-forwarder config.
+var DefaultTemplate = template.Must(NewTemplate("default", "{{ toJSON .Config }}\n"))
+
+var templateFuncs = template.FuncMap{
+	"join":    strings.Join,
+	"toJSON":  toJSON,
+	"label":   label,
+	"resolve": resolve,
+	"host":    host,
+	"port":    port,
+	"oneline": oneline,
+	"scrape":  scrape,
+	"targets": targets,
+}
+
+// NewTemplate parses text as a template with all helper functions available.
+func NewTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// NewTemplateFromFile parses the file at path as a template with all helper functions available.
+func NewTemplateFromFile(path string) (*template.Template, error) {
+	return template.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+}
+
+func render(tmpl *template.Template, destination *Destination) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, destination); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	j, err := json.MarshalIndent(v, "", "  ")
+	return string(j), err
+}
+
+func label(container *Container, key string) string {
+	return container.Labels[key]
+}
+
+func resolve(container *Container, path string) (string, error) {
+	return config.ResolvePath(container.Docker, container.DataRoot, path)
+}
+
+func host(server string) (string, error) {
+	h, _, err := net.SplitHostPort(server)
+	return h, err
+}
+
+func port(server string) (string, error) {
+	_, p, err := net.SplitHostPort(server)
+	return p, err
+}
+
+func oneline(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,319 @@
+// Package lumberjack implements a receiver of the lumberjack protocol (v1 as spoken by
+// logstash-forwarder and v2 as spoken by beats) recording every event it gets,
+// to verify what gets shipped without running Logstash.
+package lumberjack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("lumberjack")
+
+// Frame types.
+const (
+	frameWindow     = 'W'
+	frameCompressed = 'C'
+	frameData       = 'D'
+	frameJSON       = 'J'
+	frameAck        = 'A'
+)
+
+// maxFrameSize limits the memory a single frame may allocate.
+const maxFrameSize = 64 << 20
+
+// Event is a single received event.
+type Event struct {
+	// Version is the protocol version the event was sent with, 1 or 2.
+	Version  int
+	Sequence uint32
+	// Fields are the key value pairs of a v1 event (all strings) or the decoded JSON of a v2 event.
+	Fields map[string]interface{}
+	// Remote is the address of the sender.
+	Remote string
+	// Client is the common name of the client certificate, if one was presented.
+	Client string
+}
+
+// Server accepts lumberjack connections via TLS and counts all events.
+type Server struct {
+	listener net.Listener
+	// OnEvent is called for every event received, if set before events arrive.
+	OnEvent func(Event)
+	// OnError is called for every connection failing, i.e. due to a failed TLS handshake.
+	OnError func(remote string, err error)
+	// Retain keeps all events for Events & WaitFor, if set before events arrive. Memory grows with
+	// every event, so this is meant for tests.
+	Retain bool
+
+	mu       sync.Mutex
+	received int
+	events   []Event
+}
+
+// NewServer listens on addr, using tlsConfig if not nil.
+func NewServer(addr string, tlsConfig *tls.Config) (*Server, error) {
+	var listener net.Listener
+	var err error
+	if tlsConfig != nil {
+		listener, err = tls.Listen("tcp", addr, tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Server{listener: listener}, nil
+}
+
+// Addr returns the address the server listens on.
+func (server *Server) Addr() string {
+	return server.listener.Addr().String()
+}
+
+// Serve accepts connections until Close is called.
+func (server *Server) Serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := server.handle(conn); err != nil && err != io.EOF {
+				if server.OnError != nil {
+					server.OnError(conn.RemoteAddr().String(), err)
+				} else {
+					log.Warning("Connection from %s failed: %s", conn.RemoteAddr(), err)
+				}
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections.
+func (server *Server) Close() error {
+	return server.listener.Close()
+}
+
+// Received returns the number of events received so far.
+func (server *Server) Received() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.received
+}
+
+// Events returns all events received so far, nil unless Retain is set.
+func (server *Server) Events() []Event {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]Event{}, server.events...)
+}
+
+// WaitFor waits up to timeout until at least n events got received and returns them,
+// which requires Retain to be set.
+func (server *Server) WaitFor(n int, timeout time.Duration) ([]Event, error) {
+	if !server.Retain {
+		return nil, fmt.Errorf("Events are not retained")
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		events := server.Events()
+		if len(events) >= n {
+			return events, nil
+		}
+		if time.Now().After(deadline) {
+			return events, fmt.Errorf("Received %d of %d events within %s", len(events), n, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (server *Server) record(event Event) {
+	server.mu.Lock()
+	server.received++
+	if server.Retain {
+		server.events = append(server.events, event)
+	}
+	server.mu.Unlock()
+	if server.OnEvent != nil {
+		server.OnEvent(event)
+	}
+}
+
+// connection is the state of a single sender.
+type connection struct {
+	server *Server
+	conn   net.Conn
+	remote string
+	client string
+	// window is the number of events to receive before acknowledging, unacked the number received since.
+	window  uint32
+	unacked uint32
+	last    uint32
+	version byte
+}
+
+func (server *Server) handle(conn net.Conn) error {
+	c := &connection{server: server, conn: conn, remote: conn.RemoteAddr().String()}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %s", err)
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			c.client = certs[0].Subject.CommonName
+		}
+	}
+	return c.read(bufio.NewReader(conn), false)
+}
+
+// read handles frames from r until it is exhausted. Frames within a compressed frame are
+// acknowledged as a whole after the compressed frame was read.
+func (c *connection) read(r io.Reader, compressed bool) error {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		if header[0] != '1' && header[0] != '2' {
+			return fmt.Errorf("Unknown protocol version %q", header[0])
+		}
+		c.version = header[0]
+
+		switch header[1] {
+		case frameWindow:
+			size, err := readUint32(r)
+			if err != nil {
+				return err
+			}
+			c.window, c.unacked = size, 0
+		case frameCompressed:
+			payload, err := readBytes(r)
+			if err != nil {
+				return err
+			}
+			z, err := zlib.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return err
+			}
+			err = c.read(z, true)
+			z.Close()
+			if err != io.EOF {
+				return err
+			}
+			if err := c.ack(); err != nil {
+				return err
+			}
+		case frameData:
+			if err := c.readData(r); err != nil {
+				return err
+			}
+		case frameJSON:
+			if err := c.readJSON(r); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unknown frame type %q", header[1])
+		}
+
+		if !compressed && c.window > 0 && c.unacked >= c.window {
+			if err := c.ack(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *connection) readData(r io.Reader) error {
+	seq, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	pairs, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]interface{}, pairs)
+	for i := uint32(0); i < pairs; i++ {
+		key, err := readBytes(r)
+		if err != nil {
+			return err
+		}
+		value, err := readBytes(r)
+		if err != nil {
+			return err
+		}
+		fields[string(key)] = string(value)
+	}
+	c.received(1, seq, fields)
+	return nil
+}
+
+func (c *connection) readJSON(r io.Reader) error {
+	seq, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	payload, err := readBytes(r)
+	if err != nil {
+		return err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return fmt.Errorf("Invalid JSON in event %d: %s", seq, err)
+	}
+	c.received(2, seq, fields)
+	return nil
+}
+
+func (c *connection) received(version int, seq uint32, fields map[string]interface{}) {
+	c.last = seq
+	c.unacked++
+	c.server.record(Event{Version: version, Sequence: seq, Fields: fields, Remote: c.remote, Client: c.client})
+}
+
+func (c *connection) ack() error {
+	if c.unacked == 0 {
+		return nil
+	}
+	frame := []byte{c.version, frameAck, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[2:], c.last)
+	c.unacked = 0
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var n uint32
+	err := binary.Read(r, binary.BigEndian, &n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("Frame of %d bytes exceeds the limit of %d bytes", n, maxFrameSize)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,199 @@
+package lumberjack
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// client speaks the lumberjack protocol of version ('1' or '2') to a Server.
+type client struct {
+	t       *testing.T
+	conn    *tls.Conn
+	version byte
+	seq     uint32
+}
+
+func (c *client) frame(frameType byte, payload ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{c.version, frameType})
+	for _, p := range payload {
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+func (c *client) window(size uint32) []byte {
+	return c.frame(frameWindow, uint32Bytes(size))
+}
+
+// event returns a data frame (v1) or a JSON frame (v2) of the next event with fields.
+func (c *client) event(fields map[string]string) []byte {
+	c.seq++
+	if c.version == '2' {
+		payload, err := json.Marshal(fields)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		return c.frame(frameJSON, uint32Bytes(c.seq), lengthPrefixed(payload))
+	}
+	parts := [][]byte{uint32Bytes(c.seq), uint32Bytes(uint32(len(fields)))}
+	for k, v := range fields {
+		parts = append(parts, lengthPrefixed([]byte(k)), lengthPrefixed([]byte(v)))
+	}
+	return c.frame(frameData, parts...)
+}
+
+func (c *client) compressed(frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	for _, frame := range frames {
+		z.Write(frame)
+	}
+	z.Close()
+	return c.frame(frameCompressed, lengthPrefixed(buf.Bytes()))
+}
+
+func (c *client) send(frames ...[]byte) {
+	for _, frame := range frames {
+		if _, err := c.conn.Write(frame); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// expectAck reads an ack frame and checks it acknowledges seq.
+func (c *client) expectAck(seq uint32) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame := make([]byte, 6)
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		c.t.Fatalf("v%c: no ack for %d: %s", c.version, seq, err)
+	}
+	if frame[0] != c.version || frame[1] != frameAck {
+		c.t.Fatalf("v%c: got frame %q, want an ack", c.version, frame[:2])
+	}
+	if got := binary.BigEndian.Uint32(frame[2:]); got != seq {
+		c.t.Errorf("v%c: got ack for %d, want %d", c.version, got, seq)
+	}
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func lengthPrefixed(b []byte) []byte {
+	return append(uint32Bytes(uint32(len(b))), b...)
+}
+
+// newTLSServer starts a server with a generated certificate, which is returned as client certificate.
+func newTLSServer(t *testing.T, retain bool) (*Server, tls.Certificate, *x509.CertPool) {
+	dir, err := ioutil.TempDir("", "lumberjack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath, err := WriteCertificate(dir, "localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := TLSConfig(certPath, keyPath, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer("127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Retain = retain
+	server.OnError = func(remote string, err error) { t.Errorf("connection from %s failed: %s", remote, err) }
+	go server.Serve()
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemCert, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemCert)
+	return server, cert, roots
+}
+
+func dial(t *testing.T, server *Server, cert tls.Certificate, roots *x509.CertPool, version byte) *client {
+	conn, err := tls.Dial("tcp", server.Addr(), &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{t: t, conn: conn, version: version}
+}
+
+func TestServer(t *testing.T) {
+	server, cert, roots := newTLSServer(t, true)
+	defer server.Close()
+
+	for _, version := range []byte{'1', '2'} {
+		c := dial(t, server, cert, roots, version)
+
+		// plain frames are acknowledged once the window is full
+		c.send(c.window(2), c.event(map[string]string{"line": "a"}), c.event(map[string]string{"line": "b"}))
+		c.expectAck(2)
+
+		// compressed frames are acknowledged as a whole
+		c.send(c.window(3), c.compressed(c.event(map[string]string{"line": "c"}), c.event(map[string]string{"line": "d"})))
+		c.expectAck(4)
+		c.conn.Close()
+	}
+
+	events, err := server.WaitFor(8, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received := server.Received(); received != 8 {
+		t.Errorf("Received() = %d, want 8", received)
+	}
+	lines := map[int]string{}
+	for _, event := range events {
+		lines[event.Version] += event.Fields["line"].(string)
+		if event.Client != "docker-logstash-forwarder debug receiver" {
+			t.Errorf("v%d event %d: client is %q", event.Version, event.Sequence, event.Client)
+		}
+	}
+	for _, version := range []int{1, 2} {
+		if lines[version] != "abcd" {
+			t.Errorf("v%d: got lines %q, want abcd", version, lines[version])
+		}
+	}
+}
+
+func TestServerCountsWithoutRetaining(t *testing.T) {
+	server, cert, roots := newTLSServer(t, false)
+	defer server.Close()
+
+	c := dial(t, server, cert, roots, '2')
+	c.send(c.window(1), c.event(map[string]string{"line": "a"}))
+	c.expectAck(1)
+	c.conn.Close()
+
+	if received := server.Received(); received != 1 {
+		t.Errorf("Received() = %d, want 1", received)
+	}
+	if events := server.Events(); len(events) != 0 {
+		t.Errorf("retained %d events", len(events))
+	}
+	if _, err := server.WaitFor(1, time.Second); err == nil {
+		t.Error("WaitFor succeeded without retaining events")
+	}
+}
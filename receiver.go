@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/lumberjack"
+)
+
+// debugReceiver runs a lumberjack receiver printing every event as JSON to stdout until
+// a shutdown signal is received.
+//
+// args are [ADDR [CERT KEY [CA]]].
+func debugReceiver(args []string) int {
+	addr := ":5043"
+	if len(args) > 0 {
+		addr = args[0]
+	}
+
+	var cert, key, ca string
+	if len(args) >= 3 {
+		cert, key = args[1], args[2]
+	} else {
+		dir, err := ioutil.TempDir("", "lumberjack")
+		if err != nil {
+			log.Error("Unable to create certificate directory: %s", err)
+			return exitFailed
+		}
+		defer os.RemoveAll(dir)
+
+		hostname, _ := os.Hostname()
+		if cert, key, err = lumberjack.WriteCertificate(dir, hostname, "localhost", "127.0.0.1"); err != nil {
+			log.Error("Unable to create certificate: %s", err)
+			return exitFailed
+		}
+		log.Info("Using throwaway certificate %s (key %s) - use it as \"ssl ca\" of the sending side", cert, key)
+	}
+	if len(args) == 4 {
+		ca = args[3]
+	}
+
+	tlsConfig, err := lumberjack.TLSConfig(cert, key, ca)
+	if err != nil {
+		log.Error("Unable to load certificate: %s", err)
+		return exitFailed
+	}
+	server, err := lumberjack.NewServer(addr, tlsConfig)
+	if err != nil {
+		log.Error("Unable to listen on %s: %s", addr, err)
+		return exitFailed
+	}
+	server.OnEvent = func(event lumberjack.Event) {
+		j, err := json.Marshal(event)
+		if err != nil {
+			log.Error("Unable to marshal event %d from %s: %s", event.Sequence, event.Remote, err)
+			return
+		}
+		fmt.Println(string(j))
+	}
+	server.OnError = func(remote string, err error) {
+		log.Error("Connection from %s failed: %s", remote, err)
+	}
+
+	log.Info("Receiving lumberjack events on %s", server.Addr())
+	go server.Serve()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	<-signals
+	server.Close()
+	log.Info("Received %d events", server.Received())
+	return exitOK
+}
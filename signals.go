@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	shutdownSignals           = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	reloadSignal    os.Signal = syscall.SIGHUP
+	dumpSignal      os.Signal = syscall.SIGUSR1
+)
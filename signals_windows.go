@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+var (
+	shutdownSignals = []os.Signal{os.Interrupt}
+	reloadSignal    os.Signal
+	dumpSignal      os.Signal
+)
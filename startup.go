@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/forwarder"
+	"github.com/digital-wonderland/docker-logstash-forwarder/utils"
+)
+
+// ready is set to 1 once the first configuration got generated.
+var ready int32
+
+// probeLogstash waits for the servers of every known destination to accept connections,
+// exiting if they do not within -startup-timeout seconds.
+func probeLogstash(options forwarder.Options) {
+	networks, err := forwarder.Networks(options)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	for name, network := range networks {
+		network := network
+		err := utils.Retry(fmt.Sprintf("Probing %s servers %s", name, network.Servers), time.Duration(startupTimeout)*time.Second, func() error {
+			return network.Probe(10 * time.Second)
+		})
+		if err != nil {
+			log.Fatalf("Unable to reach %s servers %s: %s", name, network.Servers, err)
+		}
+		log.Info("Reached %s servers %s", name, network.Servers)
+	}
+}
+
+// markReady writes -ready-file and lets the -ready-addr endpoint report success.
+func markReady() {
+	if !atomic.CompareAndSwapInt32(&ready, 0, 1) {
+		return
+	}
+	if readyFile != "" {
+		if err := ioutil.WriteFile(readyFile, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644); err != nil {
+			log.Error("Unable to write %s: %s", readyFile, err)
+		}
+	}
+	log.Info("Ready")
+}
+
+// markUnready removes -ready-file and lets the -ready-addr endpoint report failure.
+func markUnready() {
+	atomic.StoreInt32(&ready, 0)
+	if readyFile != "" {
+		if err := os.Remove(readyFile); err != nil && !os.IsNotExist(err) {
+			log.Error("Unable to remove %s: %s", readyFile, err)
+		}
+	}
+}
+
+// serveReadiness answers GET /ready on addr with 200 once ready and 503 before.
+func serveReadiness(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 1 {
+			fmt.Fprintln(w, "ready")
+			return
+		}
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+	})
+	log.Info("Serving readiness on %s/ready", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("Unable to serve readiness on %s: %s", addr, err)
+	}
+}
@@ -2,7 +2,10 @@
 package utils
 
 import (
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -39,41 +42,147 @@ func EndPoint(sensibleDefault string, flag string, envVar string) string {
 	}
 }
 
-// RegisterDockerEventListener registers function as event listener with docker.
-// laziness defines how many seconds to wait, after an event is received, until a refresh is triggered
-func RegisterDockerEventListener(client *docker.Client, function func(), wg *sync.WaitGroup, laziness int) {
-	wg.Add(1)
+// EventSource delivers docker events, implemented by *docker.Client.
+type EventSource interface {
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+}
+
+// EventReconnectDelay is how long to wait before listening again after the docker event stream ended,
+// i.e. because dockerd got restarted.
+var EventReconnectDelay = 5 * time.Second
+
+// RegisterDockerEventListener registers function as event listener with docker until done is closed.
+// laziness defines how many seconds to wait, after an event is received, until a refresh is triggered.
+//
+// If the event stream ends, the listener is registered again after EventReconnectDelay and a refresh
+// is triggered, since events may have been missed in between.
+//
+// wg.Done() is called after the listener got removed, so callers have to wg.Add(1) beforehand.
+func RegisterDockerEventListener(client EventSource, function func(), wg *sync.WaitGroup, laziness int, done <-chan struct{}) {
 	defer wg.Done()
 
-	events := make(chan *docker.APIEvents)
-	defer close(events)
+	for listen(client, function, laziness, done) {
+		log.Warning("Docker event stream ended, listening again in %s", EventReconnectDelay)
+		select {
+		case <-time.After(EventReconnectDelay):
+		case <-done:
+			log.Info("Stopped listening to docker events")
+			return
+		}
+		Refresh.Trigger(function, laziness)
+	}
+}
 
-	err := client.AddEventListener((chan<- *docker.APIEvents)(events))
-	if err != nil {
-		log.Fatalf("Unable to add docker event listener: %s", err)
+// listen triggers a refresh for every container event until done is closed or the event stream
+// ended, reporting whether it ended.
+func listen(client EventSource, function func(), laziness int, done <-chan struct{}) bool {
+	// go-dockerclient drops events if the listener is not ready, which happens i.e. for
+	// the start event right after a create event if unbuffered. It closes the channel itself
+	// once the event stream ended, so it is never closed here.
+	events := make(chan *docker.APIEvents, 64)
+	if err := client.AddEventListener((chan<- *docker.APIEvents)(events)); err != nil {
+		log.Error("Unable to add docker event listener: %s", err)
+		return true
 	}
 	defer client.RemoveEventListener(events)
 
 	log.Info("Listening to docker events...")
 	for {
-		event := <-events
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return true
+			}
+			if event == nil {
+				continue
+			}
+			if event.Status == "start" || event.Status == "stop" || event.Status == "die" || event.Status == "destroy" {
+				id := event.ID
+				if len(id) > 12 {
+					id = id[:12]
+				}
+				log.Debug("Received event %s for container %s", event.Status, id)
 
-		if event == nil {
-			continue
+				Refresh.Trigger(function, laziness)
+			}
+		case <-done:
+			log.Info("Stopped listening to docker events")
+			return false
 		}
+	}
+}
 
-		if event.Status == "start" || event.Status == "stop" || event.Status == "die" {
-			log.Debug("Received event %s for container %s", event.Status, event.ID[:12])
+// Trigger calls function after laziness seconds, unless a refresh is pending already.
+func (refresh *ConfigRefresh) Trigger(function func(), laziness int) {
+	refresh.Mu.Lock()
+	defer refresh.Mu.Unlock()
 
-			Refresh.Mu.Lock()
-			if !Refresh.IsTriggered {
-				log.Info("Triggering refresh in %d seconds", laziness)
-				Refresh.timer = time.AfterFunc(time.Duration(laziness)*time.Second, function)
-				Refresh.IsTriggered = true
-			}
-			Refresh.Mu.Unlock()
+	if !refresh.IsTriggered {
+		log.Info("Triggering refresh in %d seconds", laziness)
+		refresh.timer = time.AfterFunc(time.Duration(laziness)*time.Second, function)
+		refresh.IsTriggered = true
+	}
+}
+
+// Stop cancels a pending refresh.
+func (refresh *ConfigRefresh) Stop() {
+	refresh.Mu.Lock()
+	defer refresh.Mu.Unlock()
+
+	if refresh.timer != nil {
+		refresh.timer.Stop()
+	}
+	refresh.IsTriggered = false
+}
+
+// MapFlag is a flag.Value collecting key=value pairs from repeated flags.
+type MapFlag map[string]string
+
+// String implements flag.Value.
+func (m MapFlag) String() string {
+	pairs := []string{}
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value.
+func (m MapFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%s is not formatted as key=value", value)
+	}
+	m[parts[0]] = parts[1]
+	return nil
+}
+
+// ListMapFlag is a flag.Value collecting key=value pairs from repeated flags, keeping the values
+// of repeated keys in the order given.
+type ListMapFlag map[string][]string
+
+// String implements flag.Value.
+func (m ListMapFlag) String() string {
+	pairs := []string{}
+	for k, values := range m {
+		for _, v := range values {
+			pairs = append(pairs, k+"="+v)
 		}
 	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value.
+func (m ListMapFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%s is not formatted as key=value", value)
+	}
+	m[parts[0]] = append(m[parts[0]], parts[1])
+	return nil
 }
 
 /*
@@ -85,3 +194,24 @@ func TimeTrack(start time.Time, name string) {
 	elapsed := time.Since(start)
 	log.Debug("%s took %s", name, elapsed)
 }
+
+// Retry calls function until it succeeds or timeout passed, doubling the delay between attempts
+// from one second up to 30 seconds. The last error is returned if timeout passed.
+func Retry(name string, timeout time.Duration, function func() error) error {
+	deadline := time.Now().Add(timeout)
+	delay := time.Second
+	for {
+		err := function()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.Warning("%s failed, retrying in %s: %s", name, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/digital-wonderland/docker-logstash-forwarder/fakedocker"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// waitForRefreshes starts containers on server until refreshes exceeds n, since fakedocker drops
+// events while the listener is (re)connecting.
+func waitForRefreshes(t *testing.T, server *fakedocker.Server, refreshes *int32, n int32) {
+	for deadline := time.Now().Add(10 * time.Second); atomic.LoadInt32(refreshes) <= n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d refreshes, want more than %d", atomic.LoadInt32(refreshes), n)
+		}
+		server.Start(&docker.Container{ID: "abc", Name: "/web", Config: &docker.Config{}})
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDockerEventListenerReconnects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "utils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+
+	delay := EventReconnectDelay
+	EventReconnectDelay = 100 * time.Millisecond
+	defer func() { EventReconnectDelay = delay }()
+
+	server, err := fakedocker.NewServer(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := docker.NewClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var refreshes int32
+	refresh := func() {
+		Refresh.Mu.Lock()
+		Refresh.IsTriggered = false
+		Refresh.Mu.Unlock()
+		atomic.AddInt32(&refreshes, 1)
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go RegisterDockerEventListener(client, refresh, &wg, 0, done)
+
+	waitForRefreshes(t, server, &refreshes, 0)
+
+	// the event stream ends, i.e. because dockerd got restarted
+	server.Close()
+	if server, err = fakedocker.NewServer(socket); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	before := atomic.LoadInt32(&refreshes)
+	waitForRefreshes(t, server, &refreshes, before+1)
+
+	close(done)
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not stop")
+	}
+	Refresh.Stop()
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_ATTRIB
+
+// FileWatcher calls a function whenever one of the watched files changes.
+//
+// The directories containing the files are watched, so files replaced via rename (or symlink swap) are detected as well.
+type FileWatcher struct {
+	fd       int
+	mu       sync.Mutex
+	files    map[string]bool
+	dirs     map[string]int
+	function func()
+}
+
+// NewFileWatcher returns a new FileWatcher calling function right after every change,
+// so it is up to function to debounce (i.e. via Refresh).
+func NewFileWatcher(function func()) (*FileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	watcher := &FileWatcher{
+		fd:       fd,
+		files:    make(map[string]bool),
+		dirs:     make(map[string]int),
+		function: function,
+	}
+	go watcher.run()
+	return watcher, nil
+}
+
+// Watch replaces the set of watched files with paths. Empty paths are ignored.
+func (watcher *FileWatcher) Watch(paths []string) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		for _, p := range watchedPaths(path) {
+			files[p] = true
+			dirs[filepath.Dir(p)] = true
+		}
+	}
+
+	for dir, wd := range watcher.dirs {
+		if !dirs[dir] {
+			syscall.InotifyRmWatch(watcher.fd, uint32(wd))
+			delete(watcher.dirs, dir)
+		}
+	}
+	for dir := range dirs {
+		if _, ok := watcher.dirs[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(watcher.fd, dir, watchMask)
+		if err != nil {
+			log.Warning("Unable to watch %s: %s", dir, err)
+			continue
+		}
+		log.Debug("Watching %s", dir)
+		watcher.dirs[dir] = wd
+	}
+	watcher.files = files
+}
+
+// watchedPaths returns the absolute path as well as the symlink target of path.
+func watchedPaths(path string) []string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return []string{path}
+	}
+	paths := []string{abs}
+	if target, err := filepath.EvalSymlinks(abs); err == nil && target != abs {
+		paths = append(paths, target)
+	}
+	return paths
+}
+
+func (watcher *FileWatcher) run() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(watcher.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Error("Unable to read file events, no longer watching files: %s", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			name := string(nameBytes)
+			for i, b := range nameBytes {
+				if b == 0 {
+					name = string(nameBytes[:i])
+					break
+				}
+			}
+			watcher.handle(int(event.Wd), name)
+		}
+	}
+}
+
+func (watcher *FileWatcher) handle(wd int, name string) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	for dir, w := range watcher.dirs {
+		if w != wd {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if watcher.files[path] {
+			log.Info("%s changed", path)
+			watcher.function()
+		}
+	}
+}
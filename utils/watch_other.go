@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import "fmt"
+
+// FileWatcher is only supported on linux.
+type FileWatcher struct{}
+
+// NewFileWatcher always fails, since watching files requires inotify.
+func NewFileWatcher(function func()) (*FileWatcher, error) {
+	return nil, fmt.Errorf("Watching files is only supported on linux")
+}
+
+// Watch does nothing.
+func (watcher *FileWatcher) Watch(paths []string) {}